@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	LogMaxSize    int64 = 10 << 20
+	LogMaxBackups       = 5
+)
+
+// consoleMu keeps lines of different processes from interleaving on the
+// console.
+var consoleMu sync.Mutex
+
+// RotatingFile is a log file that is moved aside once it would grow past
+// MaxSize. The previous files are kept as Path.1 (newest) to
+// Path.MaxBackups (oldest).
+type RotatingFile struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+
+	f    *os.File
+	size int64
+}
+
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	r := &RotatingFile{Path: path, MaxSize: maxSize, MaxBackups: maxBackups}
+	err := r.open()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = info.Size()
+	return nil
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	if r.size > 0 && r.size+int64(len(p)) > r.MaxSize {
+		err := r.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *RotatingFile) rotate() error {
+	err := r.f.Close()
+	if err != nil {
+		return err
+	}
+	os.Remove(fmt.Sprintf("%s.%d", r.Path, r.MaxBackups))
+	for i := r.MaxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.Path, i), fmt.Sprintf("%s.%d", r.Path, i+1))
+	}
+	if r.MaxBackups > 0 {
+		err = os.Rename(r.Path, r.Path+".1")
+	} else {
+		err = os.Remove(r.Path)
+	}
+	if err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *RotatingFile) Close() error {
+	return r.f.Close()
+}
+
+// ProcessLog collects the output of one process. Every line is stamped with
+// the time and the process name, echoed to the console and appended to the
+// log file of the process.
+type ProcessLog struct {
+	Name string
+
+	mu   sync.Mutex
+	file *RotatingFile
+}
+
+// NewProcessLog logs to name.log in dir.
+func NewProcessLog(dir string, name string) (*ProcessLog, error) {
+	f, err := OpenRotatingFile(filepath.Join(dir, name+".log"), LogMaxSize, LogMaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	return &ProcessLog{Name: name, file: f}, nil
+}
+
+// Line logs one line of output.
+func (l *ProcessLog) Line(s string) {
+	line := fmt.Sprintf("%s %s | %s\n", time.Now().Format("2006-01-02 15:04:05.000"), l.Name, s)
+	consoleMu.Lock()
+	os.Stdout.WriteString(line)
+	consoleMu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := l.file.Write([]byte(line))
+	if err != nil {
+		slog.Error("could not write log", "process", l.Name, "err", err)
+	}
+}
+
+func (l *ProcessLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// Writer returns a writer that logs what is written to it line by line.
+func (l *ProcessLog) Writer() *LineWriter {
+	return &LineWriter{log: l}
+}
+
+// maxLine bounds the length of a line held back while waiting for its end.
+const maxLine = 64 << 10
+
+// LineWriter splits a stream into lines for a ProcessLog. A line still open
+// when the stream ends is logged by Flush.
+type LineWriter struct {
+	log *ProcessLog
+	buf []byte
+}
+
+func (w *LineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.log.Line(string(bytes.TrimSuffix(w.buf[:i], []byte("\r"))))
+		w.buf = w.buf[i+1:]
+	}
+	if len(w.buf) > maxLine {
+		w.Flush()
+	}
+	return len(p), nil
+}
+
+func (w *LineWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.log.Line(string(w.buf))
+		w.buf = nil
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "p.log")
+	r, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dd\n", "ddddd\n"} {
+		_, err = r.Write([]byte(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.Close()
+
+	for file, want := range map[string]string{
+		path:        "dd\nddddd\n",
+		path + ".1": "cccccccc\n",
+		path + ".2": "bbbbbbbb\n",
+	} {
+		if got := readFile(t, file); got != want {
+			t.Errorf("%s holds %q, want %q", filepath.Base(file), got, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("more than two backups kept: %v", err)
+	}
+
+	// Reopening continues the current file and counts its size.
+	r, err = OpenRotatingFile(path, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Write([]byte("e\n"))
+	r.Write([]byte("a line longer than the limit\n"))
+	r.Close()
+	if got := readFile(t, path); got != "a line longer than the limit\n" {
+		t.Errorf("without backups the file holds %q", got)
+	}
+	if got := readFile(t, path+".1"); got != "cccccccc\n" {
+		t.Errorf("rotation without backups touched the old backup: %q", got)
+	}
+}
+
+func TestLineWriter(t *testing.T) {
+	dir := t.TempDir()
+	l, err := NewProcessLog(dir, "p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("x", maxLine+1)
+	w := l.Writer()
+	for _, s := range []string{"one\ntw", "o\r\nthree\r", "\n", "\n", long, "tail"} {
+		n, err := w.Write([]byte(s))
+		if n != len(s) || err != nil {
+			t.Fatalf("Write(%q) = %d, %v", s, n, err)
+		}
+	}
+	w.Flush()
+	w.Flush()
+	l.Close()
+
+	var got []string
+	for _, line := range strings.Split(strings.TrimSuffix(readFile(t, filepath.Join(dir, "p.log")), "\n"), "\n") {
+		prefix, text, ok := strings.Cut(line, " p | ")
+		if !ok || len(prefix) != len("2006-01-02 15:04:05.000") {
+			t.Fatalf("line %q lacks the time and process name", line)
+		}
+		got = append(got, text)
+	}
+	want := []string{"one", "two", "three", "", long, "tail"}
+	if len(got) != len(want) {
+		t.Fatalf("%d lines logged, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("line %d: %.20q, want %.20q", i, got[i], want[i])
+		}
+	}
+}
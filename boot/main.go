@@ -1,67 +1,137 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	"os/exec"
+	"log/slog"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"syscall"
-	
+	"time"
+
+	"github.com/LeBronQ/tasks/logging"
 	"github.com/spf13/viper"
 )
 
-func terminateProcess(pid int) error {
-	process, err := os.FindProcess(pid)
+// signalProcess sends sig to the process group led by pid, so that
+// processes started by the child get it too.
+func signalProcess(pid int, sig syscall.Signal) error {
+	// A negative pid addresses the process group.
+	return syscall.Kill(-pid, sig)
+}
+
+func main() {
+	configFile := flag.String("config", "../config.yaml", "path to the simulation config")
+	workerBin := flag.String("worker", "", "worker binary, defaults to worker/worker next to boot (build it with go build in worker/)")
+	flag.Parse()
+
+	viper.SetConfigFile(*configFile)
+	err := viper.ReadInConfig()
 	if err != nil {
-		return err
+		logging.Fatal("could not read config", "path", *configFile, "err", err)
 	}
-
-	// 使用系统调用发送终止信号
-	err = process.Signal(syscall.SIGTERM)
+	logging.Configure(viper.GetViper())
+	err = logging.Setup("boot")
 	if err != nil {
-		return err
+		logging.Fatal("could not set up logging", "err", err)
 	}
 
-	return nil
-}
+	WorkerNum := viper.GetInt("WorkerNum")
+	if viper.IsSet("RestartMinBackoff") {
+		RestartMinBackoff = viper.GetDuration("RestartMinBackoff")
+	}
+	if viper.IsSet("RestartMaxBackoff") {
+		RestartMaxBackoff = viper.GetDuration("RestartMaxBackoff")
+	}
+	if viper.IsSet("ShutdownTimeout") {
+		ShutdownTimeout = viper.GetDuration("ShutdownTimeout")
+	}
+	if viper.IsSet("LogMaxSize") {
+		LogMaxSize = int64(viper.GetSizeInBytes("LogMaxSize"))
+	}
+	if viper.IsSet("LogMaxBackups") {
+		LogMaxBackups = viper.GetInt("LogMaxBackups")
+	}
+	outputDir := "../output"
+	if viper.IsSet("OutputDir") {
+		outputDir = viper.GetString("OutputDir")
+	}
 
-func main() {
-	viper.SetConfigFile("../config.yaml")
-	err := viper.ReadInConfig()
+	currentDir, err := os.Getwd()
 	if err != nil {
-		fmt.Println("读取配置文件失败:", err)
-		return
+		logging.Fatal("could not get the working directory", "err", err)
 	}
-	 
-	WorkerNum := viper.GetInt("WorkerNum")
-	PID_arr := []int{}
-		
-	for i := 1; i <= WorkerNum; i++ {
-		currentDir, err := os.Getwd()
-		if err != nil {
-			fmt.Println("获取当前path失败:", err)
-			return
-		}
+	workerDir := filepath.Join(filepath.Dir(currentDir), "worker")
+	bin := *workerBin
+	if bin == "" {
+		bin = filepath.Join(workerDir, "worker")
+	}
+	bin, err = filepath.Abs(bin)
+	if err != nil {
+		logging.Fatal("could not resolve the worker binary", "path", bin, "err", err)
+	}
+	if _, err := os.Stat(bin); err != nil {
+		logging.Fatal("worker binary not found, build it with go build", "dir", workerDir, "err", err)
+	}
+	config, err := filepath.Abs(*configFile)
+	if err != nil {
+		logging.Fatal("could not resolve the config", "path", *configFile, "err", err)
+	}
+
+	logDir := filepath.Join(outputDir, "boot-"+time.Now().Format("20060102-150405"))
+	err = os.MkdirAll(logDir, 0755)
+	if err != nil {
+		logging.Fatal("could not create the log directory", "dir", logDir, "err", err)
+	}
+	slog.Info("logging worker output", "dir", logDir)
 
-		parentDir := filepath.Dir(currentDir)
-		workerDir := filepath.Join(parentDir, fmt.Sprintf("worker%d", i))
-		fmt.Println(workerDir)
-		
-		err = os.Chdir(workerDir)
+	procs := []*Process{}
+	for i := 1; i <= WorkerNum; i++ {
+		name := fmt.Sprintf("worker-%d", i)
+		log, err := NewProcessLog(logDir, name)
 		if err != nil {
-			fmt.Println("进入 worker目录失败:", err)
-			return
+			logging.Fatal("could not create the log file", "process", name, "err", err)
 		}
-		
-		cmd := exec.Command("sudo", "go", "run", "main.go")
-		err = cmd.Start()
+		defer log.Close()
+		logger, err := logging.New(log.Writer(), "boot")
 		if err != nil {
-			fmt.Println("执行命令失败:", err)
-			return
+			logging.Fatal("could not set up logging", "err", err)
 		}
-		PID_arr = append(PID_arr, cmd.Process.Pid)
+		procs = append(procs, &Process{
+			Name:   name,
+			Path:   bin,
+			Args:   []string{"-id", strconv.Itoa(i), "-config", config},
+			Dir:    workerDir,
+			Log:    log,
+			Logger: logger.With("process", name),
+		})
+	}
+	sup := NewSupervisor(procs)
+	sup.Start()
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		sup.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		slog.Info("all workers exited")
+	case sig := <-sigs:
+		slog.Info("stopping workers", "signal", sig)
+		go func() {
+			// A second signal kills whatever is still running.
+			<-sigs
+			slog.Warn("killing workers")
+			for _, p := range procs {
+				p.signal(syscall.SIGKILL)
+			}
+		}()
+		sup.Shutdown(sig.(syscall.Signal))
+		slog.Info("all workers stopped")
 	}
-	
-	
-	select{}
 }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	RestartMinBackoff = time.Second
+	RestartMaxBackoff = 30 * time.Second
+	// The restart backoff of a process that ran for StableAfter starts
+	// over.
+	StableAfter = time.Minute
+	// ShutdownTimeout is how long children get to exit after a signal
+	// before they are killed.
+	ShutdownTimeout = 10 * time.Second
+)
+
+// Process is one child kept running by the supervisor.
+type Process struct {
+	Name string
+	Path string
+	Args []string
+	Dir  string
+	// Log receives the output of the process. Without a Log, output goes
+	// straight to the console.
+	Log *ProcessLog
+	// Logger receives the supervisor's notes on the process, the default
+	// logger if nil.
+	Logger *slog.Logger
+
+	mu       sync.Mutex
+	cmd      *exec.Cmd
+	stopping bool
+}
+
+// Supervisor starts its processes, restarts those that crash and passes
+// shutdown signals on to them.
+type Supervisor struct {
+	procs []*Process
+	wg    sync.WaitGroup
+	mu    sync.Mutex
+	stop  chan struct{}
+}
+
+func NewSupervisor(procs []*Process) *Supervisor {
+	return &Supervisor{procs: procs, stop: make(chan struct{})}
+}
+
+// Start launches every process.
+func (s *Supervisor) Start() {
+	for _, p := range s.procs {
+		s.wg.Add(1)
+		go s.supervise(p)
+	}
+}
+
+// Wait returns once every process has exited for good.
+func (s *Supervisor) Wait() {
+	s.wg.Wait()
+}
+
+// Shutdown sends sig to every running process and stops restarting them.
+// Processes still running after ShutdownTimeout are killed. Shutdown returns
+// once all processes have exited.
+func (s *Supervisor) Shutdown(sig syscall.Signal) {
+	s.mu.Lock()
+	select {
+	case <-s.stop:
+	default:
+		close(s.stop)
+	}
+	s.mu.Unlock()
+	for _, p := range s.procs {
+		p.signal(sig)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(ShutdownTimeout):
+		for _, p := range s.procs {
+			p.signal(syscall.SIGKILL)
+		}
+		<-done
+	}
+}
+
+func (p *Process) signal(sig syscall.Signal) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopping = true
+	if p.cmd == nil {
+		return
+	}
+	err := signalProcess(p.cmd.Process.Pid, sig)
+	if err != nil && err != syscall.ESRCH {
+		p.logger().Warn("could not signal process", "signal", sig, "err", err)
+	}
+}
+
+func (p *Process) logger() *slog.Logger {
+	if p.Logger != nil {
+		return p.Logger
+	}
+	return slog.With("process", p.Name)
+}
+
+// run starts the process and waits for it to exit. A process told to stop
+// before it started is not started.
+func (p *Process) run() (time.Duration, error) {
+	cmd := exec.Command(p.Path, p.Args...)
+	cmd.Dir = p.Dir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if p.Log != nil {
+		stdout, stderr := p.Log.Writer(), p.Log.Writer()
+		defer stdout.Flush()
+		defer stderr.Flush()
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+	}
+	// A process group of its own keeps a Ctrl-C in the terminal from
+	// reaching the child before the supervisor forwards it.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	p.mu.Lock()
+	if p.stopping {
+		p.mu.Unlock()
+		return 0, nil
+	}
+	start := time.Now()
+	err := cmd.Start()
+	if err != nil {
+		p.mu.Unlock()
+		return 0, err
+	}
+	p.cmd = cmd
+	p.mu.Unlock()
+
+	err = cmd.Wait()
+	p.mu.Lock()
+	p.cmd = nil
+	p.mu.Unlock()
+	return time.Since(start), err
+}
+
+// supervise keeps p running until shutdown. A process that exits with
+// status 0 is not restarted; any other exit is a crash.
+func (s *Supervisor) supervise(p *Process) {
+	defer s.wg.Done()
+	backoff := RestartMinBackoff
+	for {
+		p.logger().Info("starting", "path", p.Path, "args", p.Args)
+		ran, err := p.run()
+		select {
+		case <-s.stop:
+			p.logger().Info("stopped")
+			return
+		default:
+		}
+		if err == nil {
+			p.logger().Info("exited", "ran", ran.Round(time.Millisecond))
+			return
+		}
+		if ran >= StableAfter {
+			backoff = RestartMinBackoff
+		}
+		p.logger().Warn("crashed, restarting", "ran", ran.Round(time.Millisecond), "err", err, "backoff", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-s.stop:
+			p.logger().Info("stopped")
+			return
+		}
+		backoff = min(2*backoff, RestartMaxBackoff)
+	}
+}
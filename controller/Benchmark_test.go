@@ -1,13 +1,134 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
 	"testing"
+
+	"github.com/LeBronQ/tasks/transport"
 )
 
-func Benchmark_main(b *testing.B) {
+// The sweep of BenchmarkSimulation, for example
+//
+//	go test -run ^$ -bench Simulation -sweep.nodes 500,2000 -sweep.workers 1,8
+var (
+	sweepNodes   = flag.String("sweep.nodes", "100,400", "comma-separated node counts")
+	sweepWorkers = flag.String("sweep.workers", "1,4", "comma-separated worker counts")
+	sweepDensity = flag.String("sweep.density", "8,32", "comma-separated mean neighbors per node")
+	sweepSteps   = flag.Int("sweep.steps", 3, "steps per run")
+	live         = flag.Bool("live", false, "run Benchmark_main against the services of ../config.yaml")
+)
 
+// Benchmark_main runs the controller as deployed, which needs Consul, Redis,
+// the model services and running workers.
+func Benchmark_main(b *testing.B) {
+	if !*live {
+		b.Skip("needs live services, run with -live")
+	}
 	for n := 0; n < b.N; n++ {
 		main()
 	}
-	
+}
+
+// BenchmarkSimulation runs whole simulations with in-process workers against
+// the stand-in services for every combination of the sweep. Besides the time
+// per run it reports the mean time per step of each phase, the links
+// computed per second of step time and the mean degree reached next to the
+// density asked for.
+func BenchmarkSimulation(b *testing.B) {
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	GraphFormats = nil
+
+	for _, nodes := range parseSweep(b, *sweepNodes) {
+		for _, workers := range parseSweep(b, *sweepWorkers) {
+			for _, density := range parseSweep(b, *sweepDensity) {
+				name := fmt.Sprintf("nodes=%d/workers=%d/density=%d", nodes, workers, density)
+				b.Run(name, func(b *testing.B) {
+					benchmarkSimulation(b, nodes, workers, float64(density))
+				})
+			}
+		}
+	}
+}
+
+func benchmarkSimulation(b *testing.B, nodes int, workers int, density float64) {
+	var total StepReport
+	var query, channel, degree float64
+	steps := 0
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		NodeNum = nodes
+		Seed = int64(i + 1)
+		Rng.Seed(Seed)
+		NodeArr = GenerateNodes()
+		r := rangeForDensity(nodes, density)
+		for _, n := range NodeArr {
+			n.Range = r
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		sim := inProcess(ctx, b, transport.NewMemory(), *sweepSteps, workers)
+		b.StartTimer()
+		err := sim.Run(ctx)
+		b.StopTimer()
+		cancel()
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, sr := range sim.Report.StepReports {
+			total.Mobility += sr.Mobility
+			total.Dispatch += sr.Dispatch
+			total.BarrierWait += sr.BarrierWait
+			total.Total += sr.Total
+			total.Links += sr.Links
+			for _, w := range sr.Workers {
+				query += w.NeighborQuery
+				channel += w.Channel
+			}
+			degree += sr.Topology.MeanDegree
+			steps++
+		}
+	}
+	b.StartTimer()
+	if steps == 0 {
+		return
+	}
+	s := float64(steps)
+	b.ReportMetric(total.Mobility/s, "mobility-s/step")
+	b.ReportMetric(total.Dispatch/s, "dispatch-s/step")
+	b.ReportMetric(total.BarrierWait/s, "barrier-s/step")
+	b.ReportMetric(query/s, "query-s/step")
+	b.ReportMetric(channel/s, "channel-s/step")
+	b.ReportMetric(float64(total.Links)/total.Total, "links/s")
+	b.ReportMetric(density, "density")
+	b.ReportMetric(degree/s, "degree")
+}
+
+// rangeForDensity returns the radio range at which a node among nodes placed
+// uniformly in the simulation area has density neighbors on average, edge
+// effects aside.
+func rangeForDensity(nodes int, density float64) float64 {
+	if nodes < 2 {
+		return 0
+	}
+	side := BoxMax - BoxMin
+	return side * math.Cbrt(3*density/(4*math.Pi*float64(nodes-1)))
+}
+
+func parseSweep(b *testing.B, s string) []int {
+	var values []int
+	for _, f := range strings.Split(s, ",") {
+		v, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || v <= 0 {
+			b.Fatalf("invalid sweep value %q", f)
+		}
+		values = append(values, v)
+	}
+	return values
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/LeBronQ/tasks"
+)
+
+var (
+	ErrStaleNotification  = errors.New("notification belongs to another run or step")
+	ErrUnknownPartition   = errors.New("notification for unknown partition")
+	ErrDuplicatePartition = errors.New("partition already reported complete")
+)
+
+// Barrier tracks which partitions of one step of one run are finished.
+type Barrier struct {
+	RunID    string
+	Step     int
+	expected map[int]bool
+	done     map[int]tasks.TaskNotification
+}
+
+// NewBarrier expects completion of the given partitions.
+func NewBarrier(runID string, step int, partitions []int) *Barrier {
+	b := &Barrier{
+		RunID:    runID,
+		Step:     step,
+		expected: make(map[int]bool, len(partitions)),
+		done:     make(map[int]tasks.TaskNotification, len(partitions)),
+	}
+	for _, p := range partitions {
+		b.expected[p] = true
+	}
+	return b
+}
+
+// Add records a completion notification. Notifications rejected by Check
+// leave the barrier unchanged.
+func (b *Barrier) Add(n tasks.TaskNotification) error {
+	err := b.Check(n)
+	if err != nil {
+		return err
+	}
+	b.done[n.Partition] = n
+	return nil
+}
+
+// Check rejects notifications for other runs or steps, for partitions
+// outside the barrier, or repeating a finished partition.
+func (b *Barrier) Check(n tasks.TaskNotification) error {
+	if n.RunID != b.RunID || n.Step != b.Step {
+		return ErrStaleNotification
+	}
+	if !b.expected[n.Partition] {
+		return fmt.Errorf("%w: %d from worker %d", ErrUnknownPartition, n.Partition, n.WorkerID)
+	}
+	if prev, ok := b.done[n.Partition]; ok {
+		return fmt.Errorf("%w: %d by worker %d, again by worker %d", ErrDuplicatePartition, n.Partition, prev.WorkerID, n.WorkerID)
+	}
+	return nil
+}
+
+// Complete reports whether every expected partition has finished.
+func (b *Barrier) Complete() bool {
+	return len(b.done) == len(b.expected)
+}
+
+// Done reports whether partition has finished.
+func (b *Barrier) Done(partition int) bool {
+	_, ok := b.done[partition]
+	return ok
+}
+
+// Missing returns the sorted IDs of partitions that have not finished yet.
+func (b *Barrier) Missing() []int {
+	missing := []int{}
+	for p := range b.expected {
+		if _, ok := b.done[p]; !ok {
+			missing = append(missing, p)
+		}
+	}
+	sort.Ints(missing)
+	return missing
+}
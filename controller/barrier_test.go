@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/LeBronQ/tasks"
+)
+
+func TestBarrier(t *testing.T) {
+	b := NewBarrier("run", 2, []int{0, 1})
+	note := func(run string, step int, partition int, worker int) tasks.TaskNotification {
+		return tasks.TaskNotification{RunID: run, Step: step, Partition: partition, WorkerID: worker}
+	}
+
+	for _, c := range []struct {
+		n    tasks.TaskNotification
+		want error
+	}{
+		{note("run", 2, 0, 1), nil},
+		{note("other", 2, 1, 1), ErrStaleNotification},
+		{note("run", 1, 1, 1), ErrStaleNotification},
+		{note("run", 2, 5, 1), ErrUnknownPartition},
+		{note("run", 2, 0, 2), ErrDuplicatePartition},
+	} {
+		if err := b.Add(c.n); !errors.Is(err, c.want) {
+			t.Errorf("Add(%+v) = %v, want %v", c.n, err, c.want)
+		}
+	}
+	if b.Complete() {
+		t.Fatal("complete with partition 1 missing")
+	}
+	if got := fmt.Sprint(b.Missing()); got != "[1]" {
+		t.Errorf("missing %s, want [1]", got)
+	}
+	if !b.Done(0) || b.Done(1) {
+		t.Errorf("done: partition 0 %v, partition 1 %v", b.Done(0), b.Done(1))
+	}
+
+	if err := b.Add(note("run", 2, 1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if !b.Complete() || len(b.Missing()) != 0 {
+		t.Errorf("not complete after every partition, missing %v", b.Missing())
+	}
+	// The rejected duplicate left the first report in place.
+	if err := b.Check(note("run", 2, 0, 3)); err == nil || err.Error() != "partition already reported complete: 0 by worker 1, again by worker 3" {
+		t.Errorf("Check of a duplicate: %v", err)
+	}
+}
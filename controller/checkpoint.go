@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/LeBronQ/Mobility"
+)
+
+// CheckpointEvery is the number of steps between checkpoints. With 0 or less
+// no checkpoints are written.
+var CheckpointEvery = 1
+
+// CheckpointVersion identifies the layout of Checkpoint.
+const CheckpointVersion = 1
+
+// Checkpoint is the controller state after a finished step, enough to carry
+// on with the next step as if the run had not stopped. Prev holds the
+// neighbor sets and load of that step; its links are in the link table
+// already written for the step.
+type Checkpoint struct {
+	Version    int         `json:"version"`
+	RunID      string      `json:"runid"`
+	Seed       int64       `json:"seed"`
+	ConfigHash string      `json:"confighash"`
+	Step       int         `json:"step"`
+	RngDraws   uint64      `json:"rngdraws"`
+	Nodes      []*Node     `json:"nodes"`
+	Prev       *StepResult `json:"prev"`
+	Report     *RunReport  `json:"report"`
+}
+
+// ConfigHash fingerprints the files that determine the results of a run.
+// Missing files hash as empty.
+func ConfigHash(paths ...string) (string, error) {
+	h := sha256.New()
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s %d\n", filepath.Base(p), len(data))
+		h.Write(data)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func checkpointPath(dir string) string {
+	return filepath.Join(dir, "checkpoint.json")
+}
+
+// WriteCheckpoint replaces the checkpoint in dir. The new checkpoint is
+// written next to the old one and renamed over it, so a crash leaves one of
+// the two intact.
+func WriteCheckpoint(dir string, cp *Checkpoint) error {
+	cp.Version = CheckpointVersion
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	cp.Report.mu.Lock()
+	data, err := json.Marshal(cp)
+	cp.Report.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := checkpointPath(dir) + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, checkpointPath(dir))
+}
+
+// LoadCheckpoint reads the checkpoint in dir.
+func LoadCheckpoint(dir string) (*Checkpoint, error) {
+	data, err := os.ReadFile(checkpointPath(dir))
+	if err != nil {
+		return nil, err
+	}
+	var cp Checkpoint
+	err = json.Unmarshal(data, &cp)
+	if err != nil {
+		return nil, err
+	}
+	if cp.Version != CheckpointVersion {
+		return nil, fmt.Errorf("checkpoint version %d, want %d", cp.Version, CheckpointVersion)
+	}
+	for i, n := range cp.Nodes {
+		if n == nil || n.ID != int64(i) {
+			return nil, fmt.Errorf("checkpoint node %d is out of order", i)
+		}
+		err = restoreMobilityParam(&n.MobNode)
+		if err != nil {
+			return nil, fmt.Errorf("checkpoint node %d: %v", i, err)
+		}
+	}
+	return &cp, nil
+}
+
+// restoreMobilityParam turns the mobility parameters of a node, decoded from
+// JSON as a map, back into the type of its mobility model.
+func restoreMobilityParam(n *Mobility.Node) error {
+	if n.Model != "RandomWalk" || n.Param == nil {
+		return nil
+	}
+	data, err := json.Marshal(n.Param)
+	if err != nil {
+		return err
+	}
+	var p Mobility.RandomWalkParam
+	err = json.Unmarshal(data, &p)
+	n.Param = p
+	return err
+}
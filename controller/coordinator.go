@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/LeBronQ/discovery"
+	"github.com/LeBronQ/tasks"
+	"github.com/LeBronQ/tasks/metrics"
+	"github.com/LeBronQ/tasks/tracing"
+	"github.com/LeBronQ/tasks/transport"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Assignment hands one partition of a step to a worker.
+type Assignment struct {
+	Partition int
+	WorkerID  int
+	Sources   []int64
+}
+
+// Assign gives partition i+1 to workers[i].
+func Assign(partitions [][]int64, workers []int) []*Assignment {
+	assignments := make([]*Assignment, len(partitions))
+	for i, p := range partitions {
+		assignments[i] = &Assignment{
+			Partition: i + 1,
+			WorkerID:  workers[i],
+			Sources:   p,
+		}
+	}
+	return assignments
+}
+
+// Coordinator dispatches the partitions of each step to the workers and
+// waits for their results, moving partitions off workers that stop sending
+// heartbeats.
+type Coordinator struct {
+	RunID     string
+	Transport transport.Controller
+	Monitor   *WorkerMonitor
+	Report    *RunReport
+
+	nodes      []tasks.NodeDescriptor
+	queues     map[int]string
+	capacities map[int]int
+}
+
+// NewCoordinator starts feeding the heartbeats arriving over t to monitor.
+func NewCoordinator(runID string, t transport.Controller, monitor *WorkerMonitor, report *RunReport) *Coordinator {
+	c := &Coordinator{
+		RunID:      runID,
+		Transport:  t,
+		Monitor:    monitor,
+		Report:     report,
+		queues:     map[int]string{},
+		capacities: map[int]int{},
+	}
+	go func() {
+		for hb := range t.Heartbeats() {
+			monitor.Beat(hb)
+		}
+	}()
+	return c
+}
+
+// SetWorkers makes the given registered workers the ones partitions are
+// handed to from now on.
+func (c *Coordinator) SetWorkers(workers []discovery.Worker) {
+	ids := make([]int, len(workers))
+	c.queues = make(map[int]string, len(workers))
+	c.capacities = make(map[int]int, len(workers))
+	for i, w := range workers {
+		ids[i] = w.ID
+		c.queues[w.ID] = w.Queue
+		c.capacities[w.ID] = max(1, w.Capacity)
+	}
+	c.Monitor.Track(ids)
+}
+
+// Slots lists each of the given workers once per task it runs at a time, so
+// that a worker is handed one partition per unit of capacity.
+func (c *Coordinator) Slots(workers []int) []int {
+	slots := []int{}
+	for _, w := range workers {
+		for i := 0; i < max(1, c.capacities[w]); i++ {
+			slots = append(slots, w)
+		}
+	}
+	return slots
+}
+
+// Dispatch sends the node set of a step to the workers, each with the
+// partitions assigned to it.
+func (c *Coordinator) Dispatch(ctx context.Context, step int, assignments []*Assignment) error {
+	c.nodes = make([]tasks.NodeDescriptor, 0, len(NodeArr))
+	for _, n := range NodeArr {
+		c.nodes = append(c.nodes, n.Descriptor())
+	}
+	for _, a := range assignments {
+		err := c.enqueue(ctx, step, a)
+		if err != nil {
+			return err
+		}
+	}
+	c.reportQueueDepth()
+	return nil
+}
+
+// reportQueueDepth exports the number of tasks in the queue of every worker.
+func (c *Coordinator) reportQueueDepth() {
+	for _, q := range c.queues {
+		n, err := c.Transport.QueueDepth(context.Background(), q)
+		if err != nil {
+			continue
+		}
+		metrics.QueueDepth.WithLabelValues(q).Set(float64(n))
+	}
+}
+
+func (c *Coordinator) enqueue(ctx context.Context, step int, a *Assignment) (err error) {
+	ctx, span := tracing.Start(ctx, "enqueue", trace.WithAttributes(
+		attribute.Int("partition", a.Partition),
+		attribute.Int("worker", a.WorkerID),
+		attribute.Int("sources", len(a.Sources)),
+	))
+	defer func() { tracing.End(span, err) }()
+	err = c.Transport.Dispatch(ctx, c.queue(a.WorkerID), tasks.KDtreeDeliveryPayload{
+		RunID:        c.RunID,
+		Seed:         Seed,
+		Step:         step,
+		Partition:    a.Partition,
+		Nodes:        c.nodes,
+		Sources:      a.Sources,
+		TraceContext: tracing.Inject(ctx),
+	})
+	if errors.Is(err, transport.ErrDuplicateTask) {
+		slog.Info("partition is already queued", "step", step, "partition", a.Partition, "worker", a.WorkerID)
+		return nil
+	}
+	return err
+}
+
+func (c *Coordinator) queue(worker int) string {
+	if q, ok := c.queues[worker]; ok {
+		return q
+	}
+	return tasks.QueueName(worker)
+}
+
+// Wait blocks until every partition of the step has been reported complete
+// and merges the partition results. Partitions of workers that miss their
+// heartbeats are re-enqueued on surviving workers. Wait gives up after
+// BarrierTimeout and names the partitions that did not finish.
+func (c *Coordinator) Wait(ctx context.Context, step int, assignments []*Assignment) (*StepResult, error) {
+	table := NewStepResult(step)
+	ids := make([]int, len(assignments))
+	hashes := make(map[int]string, len(assignments))
+	for i, a := range assignments {
+		ids[i] = a.Partition
+		hashes[a.Partition] = tasks.SourcesHash(a.Sources)
+	}
+	barrier := NewBarrier(c.RunID, step, ids)
+	timeout := time.NewTimer(BarrierTimeout)
+	defer timeout.Stop()
+	check := time.NewTicker(HeartbeatInterval)
+	defer check.Stop()
+	for !barrier.Complete() {
+		select {
+		case n, ok := <-c.Transport.Notifications():
+			if !ok {
+				return table, fmt.Errorf("step %d: notification channel closed, %s", step, missing(assignments, barrier))
+			}
+			if n.Failed {
+				// The task is retried or the step times out; only its
+				// requests are counted.
+				if n.RunID == c.RunID && n.Step == step {
+					table.ChannelCalls.Add(n.ChannelCalls)
+				}
+				continue
+			}
+			err := barrier.Check(n)
+			if errors.Is(err, ErrStaleNotification) {
+				continue
+			}
+			if err != nil {
+				slog.Warn("ignoring notification", "step", step, "partition", n.Partition, "worker", n.WorkerID, "err", err)
+				continue
+			}
+			if n.SourcesHash != hashes[n.Partition] {
+				// A task queued before the run was resumed with other
+				// partitions.
+				slog.Info("ignoring notification for other sources", "step", step, "partition", n.Partition, "worker", n.WorkerID)
+				continue
+			}
+			result, err := c.Transport.FetchResult(ctx, c.RunID, step, n.Partition, n.SourcesHash)
+			if err != nil {
+				return table, fmt.Errorf("step %d: fetching result of partition %d from worker %d: %v", step, n.Partition, n.WorkerID, err)
+			}
+			if len(result.Links) != n.LinkCount {
+				slog.Warn("reported and stored links differ", "step", step, "partition", n.Partition, "worker", n.WorkerID, "reported", n.LinkCount, "stored", len(result.Links))
+			}
+			barrier.Add(n)
+			table.Merge(result)
+			table.ChannelCalls.Add(result.ChannelCalls)
+			load := table.Load[n.WorkerID]
+			load.Sources += n.SourceCount
+			load.Links += n.LinkCount
+			load.NeighborQuery += result.NeighborQuery
+			load.Channel += result.Channel
+			table.Load[n.WorkerID] = load
+		case now := <-check.C:
+			for _, w := range c.Monitor.Check(now) {
+				hb, _ := c.Monitor.Last(w)
+				slog.Warn("worker missed its heartbeats", "step", step, "worker", w, "timeout", c.Monitor.Timeout, "tasks", hb.Tasks)
+			}
+			err := c.reassign(ctx, step, assignments, barrier)
+			if err != nil {
+				return table, err
+			}
+			c.reportQueueDepth()
+		case <-timeout.C:
+			return table, fmt.Errorf("step %d: timed out after %v, %s", step, BarrierTimeout, missing(assignments, barrier))
+		}
+	}
+	c.reportQueueDepth()
+	err := c.Transport.ReleaseResults(ctx, c.RunID, step)
+	if err != nil {
+		slog.Warn("could not release results", "step", step, "err", err)
+	}
+	return table, nil
+}
+
+// missing names the unfinished partitions of the step and the workers they
+// are currently assigned to.
+func missing(assignments []*Assignment, barrier *Barrier) string {
+	workers := map[int][]int{}
+	for _, a := range assignments {
+		if !barrier.Done(a.Partition) {
+			workers[a.WorkerID] = append(workers[a.WorkerID], a.Partition)
+		}
+	}
+	ids := make([]int, 0, len(workers))
+	for w := range workers {
+		ids = append(ids, w)
+	}
+	sort.Ints(ids)
+	parts := make([]string, len(ids))
+	for i, w := range ids {
+		sort.Ints(workers[w])
+		parts[i] = fmt.Sprintf("worker %d: %v", w, workers[w])
+	}
+	return fmt.Sprintf("missing partitions %v (%s)", barrier.Missing(), strings.Join(parts, ", "))
+}
+
+// reassign moves every unfinished partition held by a dead worker to the
+// live worker with the fewest unfinished partitions.
+func (c *Coordinator) reassign(ctx context.Context, step int, assignments []*Assignment, barrier *Barrier) error {
+	pending := map[int]bool{}
+	for _, p := range barrier.Missing() {
+		pending[p] = true
+	}
+	queued := map[int]int{}
+	for _, w := range c.Monitor.Alive() {
+		queued[w] = 0
+	}
+	for _, a := range assignments {
+		if _, ok := queued[a.WorkerID]; ok && pending[a.Partition] {
+			queued[a.WorkerID]++
+		}
+	}
+	for _, a := range assignments {
+		if !pending[a.Partition] || !c.Monitor.IsDead(a.WorkerID) {
+			continue
+		}
+		to := -1
+		for w, n := range queued {
+			if to == -1 || n < queued[to] || (n == queued[to] && w < to) {
+				to = w
+			}
+		}
+		if to == -1 {
+			return fmt.Errorf("step %d: no surviving worker for partitions %v", step, barrier.Missing())
+		}
+		from := a.WorkerID
+		a.WorkerID = to
+		err := c.enqueue(ctx, step, a)
+		if err != nil {
+			return err
+		}
+		queued[to]++
+		c.Report.AddReassignment(Reassignment{
+			Step:      step,
+			Partition: a.Partition,
+			From:      from,
+			To:        to,
+			Time:      time.Now(),
+		})
+		slog.Warn("partition moved", "step", step, "partition", a.Partition, "from", from, "to", to)
+	}
+	return nil
+}
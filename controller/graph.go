@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/LeBronQ/Mobility"
+	"github.com/LeBronQ/tasks"
+	"github.com/LeBronQ/worker/simworker"
+)
+
+// Neighbor is a directed edge of the neighbor graph. Link is nil when the
+// channel parameters of the edge could not be computed.
+type Neighbor struct {
+	ID       int64             `json:"id"`
+	Distance float64           `json:"distance"`
+	Link     *tasks.LinkResult `json:"link,omitempty"`
+}
+
+type GraphVertex struct {
+	ID        int64        `json:"id"`
+	Position  tasks.Vector `json:"position"`
+	Neighbors []Neighbor   `json:"neighbors"`
+}
+
+// NeighborGraph is the topology of one step as adjacency lists.
+type NeighborGraph struct {
+	RunID string        `json:"runid"`
+	Step  int           `json:"step"`
+	Nodes []GraphVertex `json:"nodes"`
+}
+
+// BuildNeighborGraph combines the neighbor sets and links of a step with the
+// node positions the step was computed on.
+func BuildNeighborGraph(runID string, result *StepResult, nodes []*Node) *NeighborGraph {
+	g := &NeighborGraph{
+		RunID: runID,
+		Step:  result.Step,
+		Nodes: make([]GraphVertex, 0, len(nodes)),
+	}
+	for _, n := range nodes {
+		v := GraphVertex{
+			ID:        n.ID,
+			Position:  tasks.Vector(n.MobNode.Pos),
+			Neighbors: []Neighbor{},
+		}
+		for _, id := range result.Neighbors[n.ID] {
+			e := Neighbor{
+				ID:       id,
+				Distance: Mobility.CalculateDistance3D(n.MobNode.Pos, nodes[id].MobNode.Pos),
+			}
+			if l, ok := result.Links[simworker.LinkID(n.ID, id, len(nodes))]; ok {
+				e.Link = &l
+			}
+			v.Neighbors = append(v.Neighbors, e)
+		}
+		g.Nodes = append(g.Nodes, v)
+	}
+	return g
+}
+
+// Topology summarizes the neighbor graph of a step. Edges and degrees count
+// the neighbors of each node, like links do; components are those of the
+// graph with every edge taken as undirected.
+type Topology struct {
+	Nodes            int     `json:"nodes"`
+	Edges            int     `json:"edges"`
+	MeanDegree       float64 `json:"meandegree"`
+	MinDegree        int     `json:"mindegree"`
+	MaxDegree        int     `json:"maxdegree"`
+	Isolated         int     `json:"isolated"`
+	Components       int     `json:"components"`
+	LargestComponent int     `json:"largestcomponent"`
+}
+
+// SummarizeTopology computes the topology of the neighbor sets of n nodes
+// with IDs 0 to n-1.
+func SummarizeTopology(neighbors map[int64][]int64, n int) Topology {
+	t := Topology{Nodes: n}
+	if n == 0 {
+		return t
+	}
+	parent := make([]int64, n)
+	for i := range parent {
+		parent[i] = int64(i)
+	}
+	find := func(x int64) int64 {
+		for parent[x] != x {
+			parent[x] = parent[parent[x]]
+			x = parent[x]
+		}
+		return x
+	}
+	t.MinDegree = n
+	for id := int64(0); id < int64(n); id++ {
+		d := len(neighbors[id])
+		t.Edges += d
+		t.MinDegree = min(t.MinDegree, d)
+		t.MaxDegree = max(t.MaxDegree, d)
+		if d == 0 {
+			t.Isolated++
+		}
+		for _, m := range neighbors[id] {
+			if m >= 0 && m < int64(n) {
+				parent[find(id)] = find(m)
+			}
+		}
+	}
+	t.MeanDegree = float64(t.Edges) / float64(n)
+	sizes := map[int64]int{}
+	for id := int64(0); id < int64(n); id++ {
+		sizes[find(id)]++
+	}
+	t.Components = len(sizes)
+	for _, size := range sizes {
+		t.LargestComponent = max(t.LargestComponent, size)
+	}
+	return t
+}
+
+// ExportGraph writes the graph in each of the given formats ("json",
+// "graphml", "dot") to the graph directory of the run.
+func ExportGraph(g *NeighborGraph, formats []string) error {
+	dir := filepath.Join(RunDir, "graph")
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	for _, format := range formats {
+		var write func(io.Writer, *NeighborGraph) error
+		switch format {
+		case "json":
+			write = WriteGraphJSON
+		case "graphml":
+			write = WriteGraphML
+		case "dot":
+			write = WriteGraphDOT
+		default:
+			return fmt.Errorf("unknown graph format %q", format)
+		}
+		err = writeGraphFile(filepath.Join(dir, fmt.Sprintf("step%d.%s", g.Step, format)), g, write)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeGraphFile(path string, g *NeighborGraph, write func(io.Writer, *NeighborGraph) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = write(w, g)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func WriteGraphJSON(w io.Writer, g *NeighborGraph) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(g)
+}
+
+func WriteGraphML(w io.Writer, g *NeighborGraph) error {
+	fmt.Fprintln(w, `<?xml version="1.0" encoding="UTF-8"?>`)
+	fmt.Fprintln(w, `<graphml xmlns="http://graphml.graphdrawing.org/xmlns">`)
+	for _, k := range []string{"x", "y", "z"} {
+		fmt.Fprintf(w, "  <key id=\"%s\" for=\"node\" attr.name=\"%s\" attr.type=\"double\"/>\n", k, k)
+	}
+	for _, k := range []string{"distance", "pathloss", "rxpower", "snr", "plr"} {
+		fmt.Fprintf(w, "  <key id=\"%s\" for=\"edge\" attr.name=\"%s\" attr.type=\"double\"/>\n", k, k)
+	}
+	fmt.Fprintf(w, "  <graph id=\"%s-step%d\" edgedefault=\"directed\">\n", g.RunID, g.Step)
+	for _, v := range g.Nodes {
+		fmt.Fprintf(w, "    <node id=\"n%d\">\n", v.ID)
+		fmt.Fprintf(w, "      <data key=\"x\">%g</data>\n", v.Position.X)
+		fmt.Fprintf(w, "      <data key=\"y\">%g</data>\n", v.Position.Y)
+		fmt.Fprintf(w, "      <data key=\"z\">%g</data>\n", v.Position.Z)
+		fmt.Fprintln(w, "    </node>")
+	}
+	for _, v := range g.Nodes {
+		for _, e := range v.Neighbors {
+			fmt.Fprintf(w, "    <edge source=\"n%d\" target=\"n%d\">\n", v.ID, e.ID)
+			fmt.Fprintf(w, "      <data key=\"distance\">%g</data>\n", e.Distance)
+			if e.Link != nil {
+				fmt.Fprintf(w, "      <data key=\"pathloss\">%g</data>\n", e.Link.PathLoss)
+				fmt.Fprintf(w, "      <data key=\"rxpower\">%g</data>\n", e.Link.RxPower)
+				fmt.Fprintf(w, "      <data key=\"snr\">%g</data>\n", e.Link.SNR)
+				fmt.Fprintf(w, "      <data key=\"plr\">%g</data>\n", e.Link.PLR)
+			}
+			fmt.Fprintln(w, "    </edge>")
+		}
+	}
+	fmt.Fprintln(w, "  </graph>")
+	_, err := fmt.Fprintln(w, "</graphml>")
+	return err
+}
+
+func WriteGraphDOT(w io.Writer, g *NeighborGraph) error {
+	fmt.Fprintf(w, "digraph \"%s-step%d\" {\n", g.RunID, g.Step)
+	for _, v := range g.Nodes {
+		fmt.Fprintf(w, "  n%d [pos=\"%g,%g\", z=\"%g\"];\n", v.ID, v.Position.X, v.Position.Y, v.Position.Z)
+	}
+	for _, v := range g.Nodes {
+		for _, e := range v.Neighbors {
+			if e.Link != nil {
+				fmt.Fprintf(w, "  n%d -> n%d [distance=\"%g\", pathloss=\"%g\", rxpower=\"%g\", snr=\"%g\", plr=\"%g\"];\n",
+					v.ID, e.ID, e.Distance, e.Link.PathLoss, e.Link.RxPower, e.Link.SNR, e.Link.PLR)
+			} else {
+				fmt.Fprintf(w, "  n%d -> n%d [distance=\"%g\"];\n", v.ID, e.ID, e.Distance)
+			}
+		}
+	}
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
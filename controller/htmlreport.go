@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"time"
+)
+
+// WriteReportHTML renders the report as a single HTML page with no external
+// resources.
+func WriteReportHTML(w io.Writer, r *RunReport) error {
+	config, err := json.MarshalIndent(r.Config, "", "  ")
+	if err != nil {
+		return err
+	}
+	services := make([]string, 0, len(r.Services))
+	for s := range r.Services {
+		services = append(services, s)
+	}
+	sort.Strings(services)
+	longest := 0.0
+	total := 0.0
+	for _, sr := range r.StepReports {
+		longest = max(longest, sr.Total)
+		total += sr.Total
+	}
+	return reportTemplate.Execute(w, map[string]interface{}{
+		"R":        r,
+		"Config":   string(config),
+		"Services": services,
+		"Workers":  r.WorkerTotals(),
+		"Longest":  longest,
+		"Total":    total,
+	})
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"secs": func(s float64) string { return fmt.Sprintf("%.3f", s) },
+	"pct":  func(f float64) string { return fmt.Sprintf("%.2f%%", 100*f) },
+	"time": func(t time.Time) string { return t.Format("2006-01-02 15:04:05") },
+	"bar": func(v float64, of float64) string {
+		if of <= 0 {
+			return "0"
+		}
+		return fmt.Sprintf("%.1f", 100*v/of)
+	},
+	"deg": func(f float64) string { return fmt.Sprintf("%.2f", f) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Run {{.R.RunID}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 0.25em 0.6em; text-align: right; }
+th { background: #f0f0f0; }
+td.l, th.l { text-align: left; }
+.bar { background: #4a79c4; height: 0.8em; }
+.error { color: #b00; font-weight: bold; }
+pre { background: #f7f7f7; padding: 1em; }
+</style>
+</head>
+<body>
+<h1>Run {{.R.RunID}}</h1>
+{{if .R.Error}}<p class="error">{{.R.Error}}</p>{{end}}
+<table>
+<tr><th class="l">Seed</th><td>{{.R.Seed}}</td></tr>
+<tr><th class="l">Config hash</th><td>{{.R.ConfigHash}}</td></tr>
+<tr><th class="l">Steps</th><td>{{.R.StepsDone}} / {{.R.Steps}}</td></tr>
+<tr><th class="l">Started</th><td>{{time .R.Started}}</td></tr>
+<tr><th class="l">Finished</th><td>{{time .R.Finished}}</td></tr>
+<tr><th class="l">Step time (s)</th><td>{{secs .Total}}</td></tr>
+<tr><th class="l">Links computed</th><td>{{.R.TotalLinks}}</td></tr>
+<tr><th class="l">Reassignments</th><td>{{len .R.Reassignments}}</td></tr>
+</table>
+
+<h2>Services</h2>
+<table>
+<tr><th class="l">Service</th><th>Calls</th><th>Errors</th><th>Error rate</th></tr>
+{{range .Services}}{{$c := index $.R.Services .}}<tr><td class="l">{{.}}</td><td>{{$c.Calls}}</td><td>{{$c.Errors}}</td><td>{{pct $c.ErrorRate}}</td></tr>
+{{end}}</table>
+
+<h2>Steps</h2>
+<table>
+<tr><th>Step</th><th>Mobility (s)</th><th>Dispatch (s)</th><th>Barrier wait (s)</th><th>Total (s)</th><th class="l"></th><th>Links</th><th>Mean degree</th><th>Isolated</th><th>Components</th><th>Largest</th></tr>
+{{range .R.StepReports}}<tr><td>{{.Step}}</td><td>{{secs .Mobility}}</td><td>{{secs .Dispatch}}</td><td>{{secs .BarrierWait}}</td><td>{{secs .Total}}</td><td class="l" style="width:12em"><div class="bar" style="width:{{bar .Total $.Longest}}%"></div></td><td>{{.Links}}</td><td>{{deg .Topology.MeanDegree}}</td><td>{{.Topology.Isolated}}</td><td>{{.Topology.Components}}</td><td>{{.Topology.LargestComponent}}</td></tr>
+{{end}}</table>
+
+<h2>Workers</h2>
+<table>
+<tr><th>Worker</th><th>Sources</th><th>Links</th><th>Neighbor query (s)</th><th>Channel (s)</th></tr>
+{{range .Workers}}<tr><td>{{.ID}}</td><td>{{.Sources}}</td><td>{{.Links}}</td><td>{{secs .NeighborQuery}}</td><td>{{secs .Channel}}</td></tr>
+{{end}}</table>
+{{range .R.StepReports}}<details>
+<summary>Step {{.Step}}</summary>
+<table>
+<tr><th>Worker</th><th>Sources</th><th>Links</th><th>Neighbor query (s)</th><th>Channel (s)</th></tr>
+{{range .Workers}}<tr><td>{{.ID}}</td><td>{{.Sources}}</td><td>{{.Links}}</td><td>{{secs .NeighborQuery}}</td><td>{{secs .Channel}}</td></tr>
+{{end}}</table>
+</details>
+{{end}}
+{{if .R.Reassignments}}<h2>Reassignments</h2>
+<table>
+<tr><th>Step</th><th>Partition</th><th>From</th><th>To</th><th class="l">Time</th></tr>
+{{range .R.Reassignments}}<tr><td>{{.Step}}</td><td>{{.Partition}}</td><td>{{.From}}</td><td>{{.To}}</td><td class="l">{{time .Time}}</td></tr>
+{{end}}</table>
+{{end}}
+<h2>Config</h2>
+<pre>{{.Config}}</pre>
+</body>
+</html>
+`))
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/LeBronQ/discovery"
+	"github.com/LeBronQ/tasks"
+	"github.com/LeBronQ/tasks/transport"
+	"github.com/LeBronQ/worker/simworker"
+)
+
+// Transport selects how the controller reaches its workers: "redis" for
+// worker processes serving asynq queues, "memory" for WorkerNum workers
+// running inside the controller.
+var Transport = "redis"
+
+// WorkerCapacity is the number of tasks each in-process worker runs at a
+// time.
+var WorkerCapacity = 1
+
+// StartInProcessWorkers runs workers 1..n on t until ctx is done and returns
+// them in the form the worker registry of Consul would.
+func StartInProcessWorkers(ctx context.Context, t *transport.Memory, n int, channel *discovery.Pool) []discovery.Worker {
+	workers := make([]discovery.Worker, 0, n)
+	for id := 1; id <= n; id++ {
+		w := simworker.New(id, t, channel)
+		w.Log = slog.With("worker", id)
+		queue := tasks.QueueName(id)
+		go func() {
+			err := w.Serve(ctx, queue, WorkerCapacity)
+			if err != nil {
+				w.Log.Error("worker stopped", "err", err)
+			}
+		}()
+		go w.SendHeartbeats(ctx, HeartbeatInterval)
+		workers = append(workers, discovery.Worker{ID: id, Queue: queue, Capacity: WorkerCapacity})
+	}
+	return workers
+}
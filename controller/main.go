@@ -1,23 +1,29 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"io/ioutil"
-	"log"
-	"net/http"
-	"strconv"
-	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
 
 	"github.com/LeBronQ/Mobility"
 	"github.com/LeBronQ/RadioChannelModel"
 	"github.com/LeBronQ/tasks"
-	"github.com/hibiken/asynq"
-	"github.com/go-redis/redis/v8"
 	"github.com/spf13/viper"
-	
-	consulapi "github.com/hashicorp/consul/api"
+
+	"github.com/LeBronQ/discovery"
+	"github.com/LeBronQ/tasks/logging"
+	"github.com/LeBronQ/tasks/metrics"
+	"github.com/LeBronQ/tasks/tracing"
+	"github.com/LeBronQ/tasks/transport"
+	"github.com/LeBronQ/worker/simworker"
 )
 
 const (
@@ -27,15 +33,29 @@ const (
 
 var (
 	NodeNum        = 100
+	WorkerNum      = 1
+	SimDuration    = 1.0
+	TimeStep       = Mobility.TimeStep
+	OutputDir      = "../output"
+	RunDir         = OutputDir
+	GraphFormats   = []string{"json", "graphml", "dot"}
+	BarrierTimeout = 5 * time.Minute
+	Seed           int64
+	// MetricsPort is the port of the metrics endpoint, 0 to disable it.
+	MetricsPort = 9100
 )
 
-var mobility_se = Discovery("Default_MobilityModel")
+var (
+	seedFlag   = flag.Int64("seed", 0, "random seed, overrides Seed in the config")
+	resumeFlag = flag.String("resume", "", "ID of a run to continue from its checkpoint")
+)
 
 type Node struct {
 	ID      int64
 	MobNode Mobility.Node
 	WNode   RadioChannelModel.WirelessNode
 	Range   float64
+	Channel ChannelModel
 }
 
 type ChannelModel struct {
@@ -43,12 +63,6 @@ type ChannelModel struct {
 	SmallScaleModel string `json:"smallscalemodel"`
 }
 
-type Position struct {
-	X float64 `json:"x"`
-	Y float64 `json:"y"`
-	Z float64 `json:"z"`
-}
-
 type WirelessNode struct {
 	Frequency  float64 `json:"frequency"`
 	BitRate    float64 `json:"bitrate"`
@@ -58,37 +72,16 @@ type WirelessNode struct {
 	PowerInDbm float64 `json:"powerindbm"`
 }
 
-type ChannelReqParams struct {
-	LinkId     int64                          `json:"linkid"`
-	TxNode     RadioChannelModel.WirelessNode `json:"txnode"`
-	RxNode     RadioChannelModel.WirelessNode `json:"rxnode"`
-	TxPosition RadioChannelModel.Position     `json:"txposition"`
-	RxPosition RadioChannelModel.Position     `json:"rxposition"`
-	Model      ChannelModel                   `json:"model"`
-}
-
 type MobilityReqParams struct {
 	Node Mobility.Node `json:"node"`
-}
-
-type TreeNodeData struct {
-	ID int64
-}
-
-type DeliveryPoint struct {
-	Coordinates []float64 `json:"coordinates"`
-	ID          int64     `json:"id"`
-}
-
-type KDtreeDeliveryPayload struct {
-	TreeNodes []DeliveryPoint
+	Seed int64         `json:"seed"`
 }
 
 func GenerateNodes() []*Node {
 	arr := make([]*Node, NodeNum)
 	for i := 0; i < NodeNum; i++ {
 		node := &Mobility.Node{
-			Pos:  Mobility.Nbox.RandomPosition3D(),
+			Pos:  RandomPosition3D(Rng),
 			Time: 10,
 			V: Mobility.Speed{
 				X: 10., Y: 10., Z: 10.,
@@ -112,137 +105,347 @@ func GenerateNodes() []*Node {
 			MobNode: *node,
 			WNode:   *wirelessNode,
 			Range:   2000.0,
+			Channel: ChannelModel{
+				LargeScaleModel: "FreeSpacePathLossModel",
+				SmallScaleModel: "NakagamiFadingModel",
+			},
 		}
 		arr[i] = n
 	}
 	return arr
 }
 
-func Discovery(serviceName string) []*consulapi.ServiceEntry {
-	config := consulapi.DefaultConfig()
-	config.Address = consul_address
-	client, err := consulapi.NewClient(config)
-	if err != nil {
-		fmt.Printf("consul client error: %v", err)
-	}
-	service, _, err := client.Health().Service(serviceName, "", false, nil)
-	if err != nil {
-		fmt.Printf("consul client get serviceIp error: %v", err)
+// Descriptor captures everything a worker needs to know about a node.
+func (n *Node) Descriptor() tasks.NodeDescriptor {
+	return tasks.NodeDescriptor{
+		ID:       n.ID,
+		Position: tasks.Vector(n.MobNode.Pos),
+		Velocity: tasks.Vector(n.MobNode.V),
+		Radio: tasks.RadioParams{
+			Frequency:  n.WNode.Frequency,
+			BitRate:    n.WNode.BitRate,
+			Modulation: n.WNode.Modulation,
+			BandWidth:  n.WNode.BandWidth,
+			M:          n.WNode.M,
+			PowerInDbm: n.WNode.PowerInDbm,
+		},
+		Range:           n.Range,
+		MobilityModel:   n.MobNode.Model,
+		LargeScaleModel: n.Channel.LargeScaleModel,
+		SmallScaleModel: n.Channel.SmallScaleModel,
 	}
-	return service
 }
 
-func MobilityRequest(node Mobility.Node, se *consulapi.ServiceEntry) []byte {
-	//se := Discovery("Default_MobilityModel")
-	port := se.Service.Port
-	address := se.Service.Address
-	request := "http://" + address + ":" + strconv.Itoa(port) + "/mobility"
-	param := MobilityReqParams{
-		Node: node,
-	}
-	jsonData, err := json.Marshal(param)
-	if err != nil {
-		fmt.Println("Error encoding JSON:", err)
-		return nil
+// LinkTable is the global set of links computed in one step, keyed by link ID.
+type LinkTable map[int64]tasks.LinkResult
+
+// Sorted returns the links ordered by link ID.
+func (lt LinkTable) Sorted() []tasks.LinkResult {
+	links := make([]tasks.LinkResult, 0, len(lt))
+	for _, l := range lt {
+		links = append(links, l)
 	}
+	sort.Slice(links, func(i, j int) bool { return links[i].LinkId < links[j].LinkId })
+	return links
+}
 
-	requestBody := bytes.NewBuffer(jsonData)
+// StepResult gathers all partition results of one step.
+type StepResult struct {
+	Step      int
+	Links     LinkTable
+	Neighbors map[int64][]int64
+	Load      map[int]WorkerLoad
+	// ChannelCalls counts the requests workers made to the channel service.
+	ChannelCalls tasks.ServiceCalls
+}
 
-	req, err := http.NewRequest("POST", request, requestBody)
-	if err != nil {
-		fmt.Println(err)
-		return nil
+func NewStepResult(step int) *StepResult {
+	return &StepResult{
+		Step:      step,
+		Links:     LinkTable{},
+		Neighbors: map[int64][]int64{},
+		Load:      map[int]WorkerLoad{},
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Content-Length", fmt.Sprintf("%d", requestBody.Len()))
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Println(err)
-		return nil
+// ReportLoad prints the work each worker did in the step and exports it as
+// metrics.
+func (r *StepResult) ReportLoad() {
+	ids := make([]int, 0, len(r.Load))
+	for id := range r.Load {
+		ids = append(ids, id)
 	}
-	defer resp.Body.Close()
+	sort.Ints(ids)
+	for _, id := range ids {
+		l := r.Load[id]
+		slog.Info("worker load", "step", r.Step, "worker", id, "sources", l.Sources, "links", l.Links)
+		metrics.SetWorkerLinks(id, l.Links)
+	}
+}
 
-	if resp.StatusCode != http.StatusOK {
-		fmt.Println("Unexpected status code:", resp.StatusCode)
-		return nil
+// WorkerReports lists the work of each worker in the step by worker ID.
+func (r *StepResult) WorkerReports() []WorkerReport {
+	workers := make([]WorkerReport, 0, len(r.Load))
+	for id, l := range r.Load {
+		workers = append(workers, WorkerReport{
+			ID:            id,
+			Sources:       l.Sources,
+			Links:         l.Links,
+			NeighborQuery: l.NeighborQuery.Seconds(),
+			Channel:       l.Channel.Seconds(),
+		})
 	}
+	sort.Slice(workers, func(i, j int) bool { return workers[i].ID < workers[j].ID })
+	return workers
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println("Error reading response body:", err)
-		return nil
+// Merge adds the links and neighbor sets of one partition.
+func (r *StepResult) Merge(p tasks.PartitionResult) {
+	for _, l := range p.Links {
+		r.Links[l.LinkId] = l
+	}
+	for _, n := range p.Neighbors {
+		r.Neighbors[n.ID] = n.Neighbors
 	}
-	return body
 }
 
-func UpdatePosition(NodeArr []*Node) {
-	for _, node := range NodeArr {
-		res := MobilityRequest(node.MobNode, mobility_se[0])
-		var newNode MobilityReqParams
-		err := json.Unmarshal(res, &newNode)
-		if err != nil {
-			fmt.Println("Error:", err)
-		}
-		node.MobNode = newNode.Node
+// WriteLinkTable stores the link table of one step as JSON in RunDir.
+func WriteLinkTable(step int, table LinkTable) error {
+	err := os.MkdirAll(RunDir, 0755)
+	if err != nil {
+		return err
 	}
+	data, err := json.MarshalIndent(table.Sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(RunDir, fmt.Sprintf("links_step%d.json", step)), data, 0644)
 }
 
 var NodeArr []*Node
 
+// newRunID names a run after its start time. A random suffix tells apart
+// runs started in the same second, which would otherwise share their output
+// directory, task IDs and stored results.
+func newRunID() string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(suffix)
+}
+
 func main() {
+	flag.Parse()
 	viper.SetConfigFile("../config.yaml")
 	err := viper.ReadInConfig()
 	if err != nil {
-		fmt.Println("读取配置文件失败:", err)
-		return
+		logging.Fatal("could not read config", "err", err)
+	}
+	logging.Configure(viper.GetViper())
+	err = logging.Setup("simulation-controller")
+	if err != nil {
+		logging.Fatal("could not set up logging", "err", err)
+	}
+	if viper.IsSet("NodeNum") {
+		NodeNum = viper.GetInt("NodeNum")
+	}
+	if viper.IsSet("SimDuration") {
+		SimDuration = viper.GetFloat64("SimDuration")
+	}
+	if viper.IsSet("TimeStep") {
+		TimeStep = viper.GetFloat64("TimeStep")
+	}
+	if viper.IsSet("BarrierTimeout") {
+		BarrierTimeout = viper.GetDuration("BarrierTimeout")
+	}
+	if viper.IsSet("HeartbeatInterval") {
+		HeartbeatInterval = viper.GetDuration("HeartbeatInterval")
 	}
-	NodeNum = viper.GetInt("NodeNum")
-	WorkerNum := viper.GetInt("WorkerNum")
-	
-	NodeArr = GenerateNodes()
-	client := asynq.NewClient(asynq.RedisClientOpt{Addr: redisAddr})
-	
-	redisClient := redis.NewClient(&redis.Options{
-		Addr: redisAddr, 
-	})
-	pubsub := redisClient.Subscribe(context.Background(), "task_notification")
-	defer pubsub.Close()
-	
-	defer client.Close()
-
-	deli_nodes := []tasks.DeliveryPoint{}
-	UpdatePosition(NodeArr)
-
-	for _, n := range NodeArr {
-		deli_n := tasks.DeliveryPoint{Coordinates: []float64{n.MobNode.Pos.X, n.MobNode.Pos.Y, n.MobNode.Pos.Z}, ID: n.ID}
-		deli_nodes = append(deli_nodes, deli_n)
-	}
-
-	task, err := tasks.NewKDtreeDeliveryTask(deli_nodes)
+	if viper.IsSet("HeartbeatTimeout") {
+		HeartbeatTimeout = viper.GetDuration("HeartbeatTimeout")
+	}
+	if viper.IsSet("MobilityBatchSize") {
+		MobilityBatchSize = max(1, viper.GetInt("MobilityBatchSize"))
+	}
+	if viper.IsSet("MobilityParallelism") {
+		MobilityParallelism = max(1, viper.GetInt("MobilityParallelism"))
+	}
+	if viper.IsSet("OutputDir") {
+		OutputDir = viper.GetString("OutputDir")
+	}
+	if viper.IsSet("PartitionStrategy") {
+		PartitionStrategy = viper.GetString("PartitionStrategy")
+	}
+	if viper.IsSet("MetricsPort") {
+		MetricsPort = viper.GetInt("MetricsPort")
+	}
+	tracing.Configure(viper.GetViper())
+	if viper.IsSet("Transport") {
+		Transport = viper.GetString("Transport")
+	}
+	if viper.IsSet("WorkerNum") {
+		WorkerNum = viper.GetInt("WorkerNum")
+	}
+	if viper.IsSet("WorkerCapacity") {
+		WorkerCapacity = max(1, viper.GetInt("WorkerCapacity"))
+	}
+	if viper.IsSet("ChannelBatchSize") {
+		simworker.ChannelBatchSize = viper.GetInt("ChannelBatchSize")
+	}
+	if viper.IsSet("ChannelMaxInFlight") {
+		simworker.ChannelMaxInFlight = max(1, viper.GetInt("ChannelMaxInFlight"))
+	}
+	if viper.IsSet("CheckpointEvery") {
+		CheckpointEvery = viper.GetInt("CheckpointEvery")
+	}
+	if viper.IsSet("GraphFormats") {
+		GraphFormats = viper.GetStringSlice("GraphFormats")
+	}
+	discovery.Configure(viper.GetViper())
+	_, err = TimeSlots()
+	if err != nil {
+		logging.Fatal("invalid TimeStep", "err", err)
+	}
+	StepNum, err := StepCount()
+	if err != nil {
+		logging.Fatal("invalid SimDuration", "err", err)
+	}
+	metrics.Serve(MetricsPort)
+
+	scenarioPath := ""
+	if viper.IsSet("Scenario") {
+		scenarioPath = viper.GetString("Scenario")
+		if !filepath.IsAbs(scenarioPath) {
+			scenarioPath = filepath.Join(filepath.Dir(viper.ConfigFileUsed()), scenarioPath)
+		}
+	}
+	configHash, err := ConfigHash(viper.ConfigFileUsed(), scenarioPath)
 	if err != nil {
-		log.Fatalf("could not create task: %v", err)
+		logging.Fatal("could not read config", "err", err)
 	}
-	
-	for i := 1; i <= WorkerNum; i++ {
-		queue_name := fmt.Sprintf("queue%d", i)
-		_, err = client.Enqueue(task, asynq.Queue(queue_name))
+
+	runID := newRunID()
+	var cp *Checkpoint
+	if *resumeFlag != "" {
+		cp, err = LoadCheckpoint(filepath.Join(OutputDir, *resumeFlag))
 		if err != nil {
-			log.Fatalf("could not enqueue task: %v", err)
+			logging.Fatal("could not load checkpoint", "run", *resumeFlag, "err", err)
+		}
+		if cp.ConfigHash != configHash {
+			logging.Fatal("config or scenario changed since the run was checkpointed", "run", cp.RunID)
+		}
+		runID = cp.RunID
+		Seed = cp.Seed
+		RestoreRng(Seed, cp.RngDraws)
+		NodeArr = cp.Nodes
+		NodeNum = len(NodeArr)
+	} else {
+		Seed = time.Now().UnixNano()
+		if viper.IsSet("Seed") {
+			Seed = viper.GetInt64("Seed")
+		}
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "seed" {
+				Seed = *seedFlag
+			}
+		})
+		Rng.Seed(Seed)
+
+		if scenarioPath != "" {
+			sc, err := LoadScenario(scenarioPath)
+			if err != nil {
+				logging.Fatal("could not read scenario", "path", scenarioPath, "err", err)
+			}
+			if viper.IsSet("NodeNum") && NodeNum != sc.NodeCount() {
+				slog.Warn("NodeNum is ignored, the scenario defines the nodes", "nodenum", NodeNum, "nodes", sc.NodeCount())
+			}
+			NodeNum = sc.NodeCount()
+			NodeArr = sc.BuildNodes(Rng)
+			slog.Info("scenario loaded", "scenario", sc.Name, "nodes", NodeNum, "groups", len(sc.Groups))
+		} else {
+			NodeArr = GenerateNodes()
+		}
+	}
+	slog.SetDefault(slog.With("run", runID))
+	slog.Info("seed", "seed", Seed)
+
+	ctx := context.Background()
+	shutdown, err := tracing.Setup(ctx, "simulation-controller")
+	if err != nil {
+		logging.Fatal("could not set up tracing", "err", err)
+	}
+	flushTraces := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdown(ctx); err != nil {
+			slog.Warn("could not flush traces", "err", err)
 		}
 	}
-	//log.Printf("enqueued task: id=%s queue=%s", info.ID, info.Queue)
-	
-	worker_num := 2
-	
-	msg := pubsub.Channel()
-	finish_cnt := 0
-	for _ = range msg {
-		finish_cnt++
-		if finish_cnt == worker_num {
-			break
+	defer flushTraces()
+	var t transport.Controller
+	var listWorkers func() ([]discovery.Worker, error)
+	switch Transport {
+	case "redis":
+		err = discovery.Follow(ctx, consul_address, mobilityPool)
+		if err != nil {
+			slog.Warn("could not discover the mobility service, still watching", "err", err)
+		}
+		t, err = transport.NewRedisController(redisAddr)
+		if err != nil {
+			slog.Error("could not connect to redis", "addr", redisAddr, "err", err)
+			return
+		}
+		listWorkers = func() ([]discovery.Worker, error) {
+			return discovery.Workers(consul_address)
+		}
+	case "memory":
+		channelPool := discovery.NewPool("Default_ChannelModel", discovery.NewHTTPClient())
+		err = discovery.Follow(ctx, consul_address, mobilityPool, channelPool)
+		if err != nil {
+			slog.Warn("could not discover the model services, still watching", "err", err)
 		}
+		mem := transport.NewMemory()
+		t = mem
+		workers := StartInProcessWorkers(ctx, mem, WorkerNum, channelPool)
+		listWorkers = func() ([]discovery.Worker, error) {
+			return workers, nil
+		}
+	default:
+		slog.Error("unknown transport", "transport", Transport)
+		return
+	}
+	defer t.Close()
+
+	sim := &Simulation{
+		RunID:      runID,
+		ConfigHash: configHash,
+		Steps:      StepNum,
+		Report:     NewRunReport(runID, Seed, StepNum),
+		Workers:    listWorkers,
+	}
+	if cp != nil {
+		sim.Report = cp.Report
+		sim.Report.Error = ""
+		sim.Prev = cp.Prev
+		sim.First = cp.Step + 1
+	}
+	sim.Report.ConfigHash = configHash
+	sim.Report.Config = viper.AllSettings()
+	RunDir = filepath.Join(OutputDir, sim.RunID)
+	slog.Info("run started", "output", RunDir, "steps", StepNum)
+	if cp != nil {
+		slog.Info("resuming from checkpoint", "step", cp.Step+1)
+	}
+	sim.Coord = NewCoordinator(sim.RunID, t, NewWorkerMonitor(nil, HeartbeatTimeout), sim.Report)
+
+	err = sim.Run(ctx)
+	if err != nil {
+		sim.Report.Error = err.Error()
+		sim.Report.Write(RunDir)
+		flushTraces()
+		logging.Fatal("run failed", "err", err)
+	}
+	err = sim.Report.Write(RunDir)
+	if err != nil {
+		slog.Error("could not write run report", "err", err)
 	}
-	
 }
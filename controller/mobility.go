@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"sync"
+
+	"github.com/LeBronQ/Mobility"
+	"github.com/LeBronQ/discovery"
+	"github.com/LeBronQ/tasks"
+	"github.com/LeBronQ/tasks/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	MobilityBatchSize   = 100
+	MobilityParallelism = 8
+)
+
+// mobilityBatch falls back to per-node requests once the service has
+// answered a batch request as unknown.
+var mobilityBatch = discovery.BatchFallback{Service: "mobility"}
+
+// mobilityPool spreads mobility requests over the passing instances of the
+// mobility service.
+var mobilityPool = discovery.NewPool("Default_MobilityModel", discovery.NewHTTPClient())
+
+type MobilityBatchReqParams struct {
+	Nodes []MobilityReqParams `json:"nodes"`
+}
+
+// MobilityRequest moves one node by one time slot.
+func MobilityRequest(ctx context.Context, node Mobility.Node, seed int64, pool *discovery.Pool) (_ Mobility.Node, err error) {
+	ctx, span := tracing.Start(ctx, "MobilityRequest", trace.WithAttributes(attribute.Int64("node", node.ID)))
+	defer func() { tracing.End(span, err) }()
+	param := MobilityReqParams{
+		Node: node,
+		Seed: seed,
+	}
+	var res MobilityReqParams
+	err = pool.Post(ctx, "/mobility", param, &res)
+	return res.Node, err
+}
+
+// MobilityBatchRequest moves many nodes by one time slot in one request. The
+// answer lists the nodes in request order.
+func MobilityBatchRequest(ctx context.Context, params []MobilityReqParams, pool *discovery.Pool) (_ []Mobility.Node, err error) {
+	ctx, span := tracing.Start(ctx, "MobilityBatchRequest", trace.WithAttributes(attribute.Int("nodes", len(params))))
+	defer func() { tracing.End(span, err) }()
+	var res MobilityBatchReqParams
+	err = pool.Post(ctx, "/mobility/batch", MobilityBatchReqParams{Nodes: params}, &res)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Nodes) != len(params) {
+		return nil, fmt.Errorf("batch of %d nodes answered with %d", len(params), len(res.Nodes))
+	}
+	nodes := make([]Mobility.Node, len(res.Nodes))
+	for i, r := range res.Nodes {
+		nodes[i] = r.Node
+	}
+	return nodes, nil
+}
+
+// advanceBatch moves a batch of nodes through all time slots of a step,
+// using the batch endpoint while the service supports it. It stops at the
+// first request that fails.
+func advanceBatch(ctx context.Context, batch []*Node, step int, slots int) error {
+	for slot := 0; slot < slots; slot++ {
+		params := make([]MobilityReqParams, len(batch))
+		for i, n := range batch {
+			params[i] = MobilityReqParams{
+				Node: n.MobNode,
+				Seed: tasks.DeriveSeed(Seed, int64(step), n.ID, int64(slot)),
+			}
+		}
+		err := mobilityBatch.Do(func() error {
+			nodes, err := MobilityBatchRequest(ctx, params, mobilityPool)
+			if discovery.BatchUnsupported(err) {
+				return err
+			}
+			if err != nil {
+				slog.Warn("mobility batch failed", "step", step, "node", batch[0].ID, "nodes", len(batch), "err", err)
+				return fmt.Errorf("mobility batch of %d nodes from node %d: %w", len(batch), batch[0].ID, err)
+			}
+			for i, n := range batch {
+				n.MobNode = nodes[i]
+			}
+			return nil
+		}, func() error {
+			for i, n := range batch {
+				node, err := MobilityRequest(ctx, params[i].Node, params[i].Seed, mobilityPool)
+				if err != nil {
+					slog.Warn("mobility request failed", "step", step, "node", n.ID, "err", err)
+					return fmt.Errorf("mobility of node %d: %w", n.ID, err)
+				}
+				n.MobNode = node
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TimeSlots returns the number of mobility time slots in a step of TimeStep
+// seconds, failing unless TimeStep is a positive multiple of
+// Mobility.TimeSlot.
+func TimeSlots() (int, error) {
+	slots := math.Round(TimeStep / Mobility.TimeSlot)
+	if slots < 1 || math.Abs(slots*Mobility.TimeSlot-TimeStep) > 1e-9*TimeStep {
+		return 0, fmt.Errorf("TimeStep %v is not a positive multiple of the mobility time slot %v", TimeStep, Mobility.TimeSlot)
+	}
+	return int(slots), nil
+}
+
+// StepCount returns the number of steps of TimeStep seconds in SimDuration,
+// failing unless SimDuration is a positive multiple of TimeStep.
+func StepCount() (int, error) {
+	steps := math.Round(SimDuration / TimeStep)
+	if steps < 1 || math.Abs(steps*TimeStep-SimDuration) > 1e-9*SimDuration {
+		return 0, fmt.Errorf("SimDuration %v is not a positive multiple of TimeStep %v", SimDuration, TimeStep)
+	}
+	return int(steps), nil
+}
+
+// UpdatePosition advances every node by one simulation step. The mobility
+// service moves a node by Mobility.TimeSlot per request, so a step of
+// TimeStep seconds takes TimeStep/TimeSlot requests per node. Nodes are sent
+// in batches of MobilityBatchSize by MobilityParallelism concurrent senders.
+// UpdatePosition fails if any node could not be moved; the node set is then
+// only partly advanced. It returns the requests made to the mobility service.
+func UpdatePosition(ctx context.Context, NodeArr []*Node, step int) (tasks.ServiceCalls, error) {
+	slots, err := TimeSlots()
+	if err != nil {
+		return tasks.ServiceCalls{}, err
+	}
+	counter := &discovery.CallCounter{}
+	ctx = discovery.WithCallCounter(ctx, counter)
+	batches := make(chan []*Node)
+	var mu sync.Mutex
+	var errs []error
+	var wg sync.WaitGroup
+	for w := 0; w < MobilityParallelism; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range batches {
+				err := advanceBatch(ctx, b, step, slots)
+				if err != nil {
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	n := 0
+	for i := 0; i < len(NodeArr); i += MobilityBatchSize {
+		batches <- NodeArr[i:min(i+MobilityBatchSize, len(NodeArr))]
+		n++
+	}
+	close(batches)
+	wg.Wait()
+	attempts, failed := counter.Counts()
+	calls := tasks.ServiceCalls{Calls: attempts, Errors: failed}
+	if len(errs) > 0 {
+		return calls, fmt.Errorf("%d of %d mobility batches failed, first: %w", len(errs), n, errs[0])
+	}
+	return calls, nil
+}
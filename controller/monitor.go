@@ -0,0 +1,124 @@
+package main
+
+import (
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/LeBronQ/tasks"
+)
+
+var (
+	HeartbeatInterval = 2 * time.Second
+	HeartbeatTimeout  = 10 * time.Second
+)
+
+// WorkerMonitor follows worker heartbeats and declares a worker dead once it
+// has been silent for longer than Timeout. A dead worker that sends a
+// heartbeat again is taken back.
+type WorkerMonitor struct {
+	Timeout  time.Duration
+	mu       sync.Mutex
+	lastSeen map[int]time.Time
+	last     map[int]tasks.Heartbeat
+	dead     map[int]bool
+}
+
+// NewWorkerMonitor watches the given workers, counting them as seen now.
+func NewWorkerMonitor(workers []int, timeout time.Duration) *WorkerMonitor {
+	m := &WorkerMonitor{
+		Timeout:  timeout,
+		lastSeen: make(map[int]time.Time, len(workers)),
+		last:     make(map[int]tasks.Heartbeat, len(workers)),
+		dead:     map[int]bool{},
+	}
+	now := time.Now()
+	for _, w := range workers {
+		m.lastSeen[w] = now
+	}
+	return m
+}
+
+// Track replaces the watched workers. Workers new to the monitor count as
+// seen now; workers left out are forgotten.
+func (m *WorkerMonitor) Track(workers []int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keep := make(map[int]bool, len(workers))
+	now := time.Now()
+	for _, w := range workers {
+		keep[w] = true
+		if _, ok := m.lastSeen[w]; !ok {
+			m.lastSeen[w] = now
+			slog.Info("worker joined", "worker", w)
+		}
+	}
+	for w := range m.lastSeen {
+		if !keep[w] {
+			delete(m.lastSeen, w)
+			delete(m.last, w)
+			delete(m.dead, w)
+			slog.Info("worker left", "worker", w)
+		}
+	}
+}
+
+// Beat records a heartbeat. Heartbeats of unknown workers are ignored.
+func (m *WorkerMonitor) Beat(hb tasks.Heartbeat) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.lastSeen[hb.WorkerID]; !ok {
+		return
+	}
+	m.lastSeen[hb.WorkerID] = time.Now()
+	m.last[hb.WorkerID] = hb
+	if m.dead[hb.WorkerID] {
+		delete(m.dead, hb.WorkerID)
+		slog.Info("worker is back", "worker", hb.WorkerID)
+	}
+}
+
+// Check declares every live worker silent since before now-Timeout dead and
+// returns the newly dead workers.
+func (m *WorkerMonitor) Check(now time.Time) []int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	died := []int{}
+	for w, seen := range m.lastSeen {
+		if !m.dead[w] && now.Sub(seen) > m.Timeout {
+			m.dead[w] = true
+			died = append(died, w)
+		}
+	}
+	sort.Ints(died)
+	return died
+}
+
+func (m *WorkerMonitor) IsDead(worker int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.dead[worker]
+}
+
+// Alive returns the sorted IDs of the workers not declared dead.
+func (m *WorkerMonitor) Alive() []int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	alive := []int{}
+	for w := range m.lastSeen {
+		if !m.dead[w] {
+			alive = append(alive, w)
+		}
+	}
+	sort.Ints(alive)
+	return alive
+}
+
+// Last returns the most recent heartbeat of a worker.
+func (m *WorkerMonitor) Last(worker int) (tasks.Heartbeat, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hb, ok := m.last[worker]
+	return hb, ok
+}
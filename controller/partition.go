@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// PartitionStrategy selects how source nodes are split across workers:
+//
+//	range  contiguous ID ranges
+//	kd     recursive median splits along the widest axis, equal node counts
+//	grid   cells of a regular X-Y grid, walked in serpentine order
+//	links  like kd, but balancing the link count estimated from the
+//	       neighbor sets of the previous step
+var PartitionStrategy = "kd"
+
+// WorkerLoad is the work one worker did in a step.
+type WorkerLoad struct {
+	Sources       int
+	Links         int
+	NeighborQuery time.Duration
+	Channel       time.Duration
+}
+
+// PartitionNodes returns one list of source node IDs per worker. prev holds
+// the result of the previous step and may be nil.
+func PartitionNodes(strategy string, nodes []*Node, workers int, prev *StepResult) ([][]int64, error) {
+	ids := make([]int64, len(nodes))
+	for i, n := range nodes {
+		ids[i] = n.ID
+	}
+	switch strategy {
+	case "range":
+		return rangeSplit(ids, workers), nil
+	case "kd":
+		return kdSplit(nodes, ids, nil, workers), nil
+	case "grid":
+		return gridSplit(nodes, ids, workers), nil
+	case "links":
+		weights := make(map[int64]float64, len(ids))
+		for _, id := range ids {
+			weights[id] = 1
+			if prev != nil {
+				weights[id] += float64(len(prev.Neighbors[id]))
+			}
+		}
+		return kdSplit(nodes, ids, weights, workers), nil
+	default:
+		return nil, fmt.Errorf("unknown partition strategy %q", strategy)
+	}
+}
+
+// rangeSplit cuts ids into workers contiguous parts whose sizes differ by at
+// most one.
+func rangeSplit(ids []int64, workers int) [][]int64 {
+	parts := make([][]int64, workers)
+	size := len(ids) / workers
+	rem := len(ids) % workers
+	start := 0
+	for i := 0; i < workers; i++ {
+		end := start + size
+		if i < rem {
+			end++
+		}
+		parts[i] = ids[start:end]
+		start = end
+	}
+	return parts
+}
+
+// kdSplit bisects the nodes along the axis of widest extent until there is
+// one part per worker. Each cut gives both halves a share of the total
+// weight proportional to the number of workers they receive. A nil weights
+// map counts every node once.
+func kdSplit(nodes []*Node, ids []int64, weights map[int64]float64, workers int) [][]int64 {
+	if workers == 1 {
+		return [][]int64{ids}
+	}
+	coord := func(id int64, axis int) float64 {
+		pos := nodes[id].MobNode.Pos
+		return [3]float64{pos.X, pos.Y, pos.Z}[axis]
+	}
+	weight := func(id int64) float64 {
+		if weights == nil {
+			return 1
+		}
+		return weights[id]
+	}
+
+	axis, widest := 0, -1.0
+	for a := 0; a < 3; a++ {
+		lo, hi := math.Inf(1), math.Inf(-1)
+		for _, id := range ids {
+			lo = math.Min(lo, coord(id, a))
+			hi = math.Max(hi, coord(id, a))
+		}
+		if hi-lo > widest {
+			axis, widest = a, hi-lo
+		}
+	}
+	sorted := append([]int64(nil), ids...)
+	sort.SliceStable(sorted, func(i, j int) bool { return coord(sorted[i], axis) < coord(sorted[j], axis) })
+
+	left := workers / 2
+	total := 0.0
+	for _, id := range sorted {
+		total += weight(id)
+	}
+	target := total * float64(left) / float64(workers)
+	cut, acc := 0, 0.0
+	for cut < len(sorted) && acc+weight(sorted[cut])/2 < target {
+		acc += weight(sorted[cut])
+		cut++
+	}
+	parts := kdSplit(nodes, sorted[:cut], weights, left)
+	return append(parts, kdSplit(nodes, sorted[cut:], weights, workers-left)...)
+}
+
+// gridSplit lays a square grid over the X-Y plane with about four cells per
+// worker, walks the cells row by row in alternating direction and cuts the
+// resulting node sequence into parts of equal size.
+func gridSplit(nodes []*Node, ids []int64, workers int) [][]int64 {
+	side := int(math.Ceil(math.Sqrt(float64(4 * workers))))
+	cellSize := (BoxMax - BoxMin) / float64(side)
+	cellOf := func(id int64) int {
+		pos := nodes[id].MobNode.Pos
+		cx := min(side-1, max(0, int((pos.X-BoxMin)/cellSize)))
+		cy := min(side-1, max(0, int((pos.Y-BoxMin)/cellSize)))
+		if cy%2 == 1 {
+			cx = side - 1 - cx
+		}
+		return cy*side + cx
+	}
+	sorted := append([]int64(nil), ids...)
+	sort.SliceStable(sorted, func(i, j int) bool { return cellOf(sorted[i]) < cellOf(sorted[j]) })
+	return rangeSplit(sorted, workers)
+}
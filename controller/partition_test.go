@@ -0,0 +1,86 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func testNodes(n int) []*Node {
+	NodeNum = n
+	Rng.Seed(1)
+	return GenerateNodes()
+}
+
+func TestPartitionNodes(t *testing.T) {
+	for _, strategy := range []string{"range", "kd", "grid", "links"} {
+		for _, c := range []struct{ nodes, workers int }{
+			{1, 1},
+			{60, 1},
+			{60, 4},
+			{100, 7},
+			{3, 5},
+			{0, 2},
+		} {
+			nodes := testNodes(c.nodes)
+			parts, err := PartitionNodes(strategy, nodes, c.workers, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(parts) != c.workers {
+				t.Errorf("%s, %d nodes: %d parts for %d workers", strategy, c.nodes, len(parts), c.workers)
+			}
+			seen := map[int64]int{}
+			for _, p := range parts {
+				for _, id := range p {
+					seen[id]++
+				}
+			}
+			for _, n := range nodes {
+				if seen[n.ID] != 1 {
+					t.Errorf("%s, %d nodes, %d workers: node %d in %d parts", strategy, c.nodes, c.workers, n.ID, seen[n.ID])
+				}
+			}
+			if len(seen) != len(nodes) {
+				t.Errorf("%s, %d nodes, %d workers: %d distinct IDs in the parts", strategy, c.nodes, c.workers, len(seen))
+			}
+		}
+	}
+	if _, err := PartitionNodes("hash", testNodes(4), 2, nil); err == nil {
+		t.Error("unknown strategy accepted")
+	}
+}
+
+func TestPartitionNodesBalancesLinks(t *testing.T) {
+	const workers = 4
+	nodes := testNodes(200)
+	// Nodes in the lower half of X have 19 neighbors, the others none.
+	prev := NewStepResult(0)
+	for _, n := range nodes {
+		if n.MobNode.Pos.X < (BoxMin+BoxMax)/2 {
+			prev.Neighbors[n.ID] = make([]int64, 19)
+		}
+	}
+	weight := func(id int64) float64 {
+		return 1 + float64(len(prev.Neighbors[id]))
+	}
+
+	parts, err := PartitionNodes("links", nodes, workers, prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 0.0
+	for _, n := range nodes {
+		total += weight(n.ID)
+	}
+	// Each of the two levels of cuts misses its target by at most half the
+	// weight of a node.
+	for i, p := range parts {
+		w := 0.0
+		for _, id := range p {
+			w += weight(id)
+		}
+		if math.Abs(w-total/workers) > 20 {
+			t.Errorf("part %d weighs %v of %v, want about %v", i, w, total, total/workers)
+		}
+	}
+}
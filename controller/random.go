@@ -0,0 +1,67 @@
+package main
+
+import (
+	"math/rand"
+
+	"github.com/LeBronQ/Mobility"
+)
+
+// Bounds of the simulation area, identical to Mobility.Nbox whose limits are
+// not exported.
+const (
+	BoxMin = 0.0
+	BoxMax = 4000.0
+)
+
+// Rng drives every random draw made by the controller. It is reseeded from
+// Seed at startup so that a run is reproducible from its seed.
+var (
+	rngSrc = &countingSource{src: rand.NewSource(1).(rand.Source64)}
+	Rng    = rand.New(rngSrc)
+)
+
+// countingSource counts the values drawn since it was last seeded, which
+// together with the seed is the state of the source.
+type countingSource struct {
+	src   rand.Source64
+	draws uint64
+}
+
+func (s *countingSource) Int63() int64 {
+	s.draws++
+	return s.src.Int63()
+}
+
+func (s *countingSource) Uint64() uint64 {
+	s.draws++
+	return s.src.Uint64()
+}
+
+func (s *countingSource) Seed(seed int64) {
+	s.src.Seed(seed)
+	s.draws = 0
+}
+
+// RngDraws returns the number of values drawn from Rng since it was seeded.
+func RngDraws() uint64 {
+	return rngSrc.draws
+}
+
+// RestoreRng puts Rng into the state it had after draws values were drawn
+// following Rng.Seed(seed).
+func RestoreRng(seed int64, draws uint64) {
+	Rng.Seed(seed)
+	for i := uint64(0); i < draws; i++ {
+		rngSrc.Uint64()
+	}
+}
+
+// RandomPosition3D draws a uniform position inside the simulation area.
+// Unlike Mobility.Nbox.RandomPosition3D it does not reseed a global source.
+func RandomPosition3D(rng *rand.Rand) Mobility.Position {
+	var pos Mobility.Position
+	pos.X = BoxMin + rng.Float64()*(BoxMax-BoxMin)
+	pos.Y = BoxMin + rng.Float64()*(BoxMax-BoxMin)
+	pos.Z = BoxMin + rng.Float64()*(BoxMax-BoxMin)
+	return pos
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/LeBronQ/tasks"
+)
+
+// Reassignment records a partition moved off a dead worker.
+type Reassignment struct {
+	Step      int       `json:"step"`
+	Partition int       `json:"partition"`
+	From      int       `json:"from"`
+	To        int       `json:"to"`
+	Time      time.Time `json:"time"`
+}
+
+// WorkerReport is the work one worker did, in a step or over the run. Times
+// are in seconds.
+type WorkerReport struct {
+	ID            int     `json:"id"`
+	Sources       int     `json:"sources"`
+	Links         int     `json:"links"`
+	NeighborQuery float64 `json:"neighborquery"`
+	Channel       float64 `json:"channel"`
+}
+
+// StepReport holds the phase timings and outcome of one step. Times are in
+// seconds.
+type StepReport struct {
+	Step        int            `json:"step"`
+	Mobility    float64        `json:"mobility"`
+	Dispatch    float64        `json:"dispatch"`
+	BarrierWait float64        `json:"barrierwait"`
+	Total       float64        `json:"total"`
+	Links       int            `json:"links"`
+	Workers     []WorkerReport `json:"workers"`
+	Topology    Topology       `json:"topology"`
+}
+
+// RunReport summarizes a run. It is written to report.json and report.html
+// in the run directory when the run ends, successfully or not.
+type RunReport struct {
+	mu         sync.Mutex
+	RunID      string                 `json:"runid"`
+	Seed       int64                  `json:"seed"`
+	ConfigHash string                 `json:"confighash"`
+	Config     map[string]interface{} `json:"config"`
+	Steps      int                    `json:"steps"`
+	StepsDone  int                    `json:"stepsdone"`
+	Started    time.Time              `json:"started"`
+	Finished   time.Time              `json:"finished"`
+	Error      string                 `json:"error,omitempty"`
+	TotalLinks int                    `json:"totallinks"`
+	// Services counts the requests made to each model service.
+	Services      map[string]tasks.ServiceCalls `json:"services"`
+	StepReports   []StepReport                  `json:"stepreports"`
+	Reassignments []Reassignment                `json:"reassignments"`
+}
+
+func NewRunReport(runID string, seed int64, steps int) *RunReport {
+	return &RunReport{
+		RunID:         runID,
+		Seed:          seed,
+		Steps:         steps,
+		Started:       time.Now(),
+		Services:      map[string]tasks.ServiceCalls{},
+		StepReports:   []StepReport{},
+		Reassignments: []Reassignment{},
+	}
+}
+
+func (r *RunReport) AddReassignment(ra Reassignment) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Reassignments = append(r.Reassignments, ra)
+}
+
+// AddStep records a finished step.
+func (r *RunReport) AddStep(sr StepReport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.StepReports = append(r.StepReports, sr)
+	r.StepsDone = sr.Step + 1
+	r.TotalLinks += sr.Links
+}
+
+// AddCalls adds requests made to a model service.
+func (r *RunReport) AddCalls(service string, c tasks.ServiceCalls) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Services == nil {
+		r.Services = map[string]tasks.ServiceCalls{}
+	}
+	total := r.Services[service]
+	total.Add(c)
+	r.Services[service] = total
+}
+
+// WorkerTotals sums the work of each worker over all steps.
+func (r *RunReport) WorkerTotals() []WorkerReport {
+	byID := map[int]*WorkerReport{}
+	for _, sr := range r.StepReports {
+		for _, w := range sr.Workers {
+			t, ok := byID[w.ID]
+			if !ok {
+				t = &WorkerReport{ID: w.ID}
+				byID[w.ID] = t
+			}
+			t.Sources += w.Sources
+			t.Links += w.Links
+			t.NeighborQuery += w.NeighborQuery
+			t.Channel += w.Channel
+		}
+	}
+	totals := make([]WorkerReport, 0, len(byID))
+	for _, t := range byID {
+		totals = append(totals, *t)
+	}
+	sort.Slice(totals, func(i, j int) bool { return totals[i].ID < totals[j].ID })
+	return totals
+}
+
+// Write stores the report as report.json and report.html in dir.
+func (r *RunReport) Write(dir string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	r.Finished = time.Now()
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filepath.Join(dir, "report.json"), data, 0644)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(dir, "report.html"))
+	if err != nil {
+		return err
+	}
+	err = WriteReportHTML(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
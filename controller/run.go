@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/LeBronQ/discovery"
+	"github.com/LeBronQ/tasks/metrics"
+	"github.com/LeBronQ/tasks/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Simulation carries a run through its steps.
+type Simulation struct {
+	RunID      string
+	ConfigHash string
+	// Steps is the number of steps of the run; First is the step to
+	// compute next and Prev the result of the step before it, if any.
+	Steps  int
+	First  int
+	Prev   *StepResult
+	Coord  *Coordinator
+	Report *RunReport
+	// Workers lists the workers available for a step.
+	Workers func() ([]discovery.Worker, error)
+}
+
+// Run computes the remaining steps, writing the results of each step to
+// RunDir.
+func (s *Simulation) Run(ctx context.Context) error {
+	for step := s.First; step < s.Steps; step++ {
+		err := s.step(ctx, step)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// liveWorkers refreshes the worker set and returns the live workers. While
+// there are none, as before the workers' first registration, it polls
+// Workers every HeartbeatInterval and gives up after BarrierTimeout.
+func (s *Simulation) liveWorkers(ctx context.Context, step int) ([]int, error) {
+	deadline := time.Now().Add(BarrierTimeout)
+	for {
+		workers, err := s.Workers()
+		if err != nil {
+			slog.Warn("could not list workers, keeping the previous set", "step", step, "err", err)
+		} else {
+			s.Coord.SetWorkers(workers)
+		}
+		alive := s.Coord.Monitor.Alive()
+		if len(alive) > 0 {
+			return alive, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("step %d: no live workers after %v", step, BarrierTimeout)
+		}
+		slog.Info("waiting for workers", "step", step)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(HeartbeatInterval):
+		}
+	}
+}
+
+// step computes one step under a span of its own.
+func (s *Simulation) step(ctx context.Context, step int) (err error) {
+	ctx, span := tracing.Start(ctx, "step", trace.WithAttributes(
+		attribute.String("run", s.RunID),
+		attribute.Int("step", step),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	begin := time.Now()
+	sr := StepReport{Step: step}
+	mctx, mspan := tracing.Start(ctx, "UpdatePosition")
+	calls, err := UpdatePosition(mctx, NodeArr, step)
+	tracing.End(mspan, err)
+	s.Report.AddCalls("mobility", calls)
+	if err != nil {
+		return fmt.Errorf("step %d: %v", step, err)
+	}
+	sr.Mobility = metrics.ObservePhase(metrics.PhaseMobility, begin).Seconds()
+	alive, err := s.liveWorkers(ctx, step)
+	if err != nil {
+		return err
+	}
+	slots := s.Coord.Slots(alive)
+	partitions, err := PartitionNodes(PartitionStrategy, NodeArr, len(slots), s.Prev)
+	if err != nil {
+		return fmt.Errorf("step %d: %v", step, err)
+	}
+	assignments := Assign(partitions, slots)
+	start := time.Now()
+	err = s.Coord.Dispatch(ctx, step, assignments)
+	if err != nil {
+		return fmt.Errorf("step %d: %v", step, err)
+	}
+	sr.Dispatch = metrics.ObservePhase(metrics.PhaseDispatch, start).Seconds()
+	start = time.Now()
+	wctx, wspan := tracing.Start(ctx, "Wait")
+	result, err := s.Coord.Wait(wctx, step, assignments)
+	tracing.End(wspan, err)
+	s.Report.AddCalls("channel", result.ChannelCalls)
+	if err != nil {
+		return err
+	}
+	sr.BarrierWait = metrics.ObservePhase(metrics.PhaseBarrierWait, start).Seconds()
+	err = WriteLinkTable(step, result.Links)
+	if err != nil {
+		slog.Error("could not write link table", "step", step, "err", err)
+	}
+	err = ExportGraph(BuildNeighborGraph(s.RunID, result, NodeArr), GraphFormats)
+	if err != nil {
+		slog.Error("could not export neighbor graph", "step", step, "err", err)
+	}
+	slog.Info("step finished", "step", step, "steps", s.Steps, "links", len(result.Links))
+	span.SetAttributes(attribute.Int("links", len(result.Links)))
+	result.ReportLoad()
+	sr.Total = time.Since(begin).Seconds()
+	sr.Links = len(result.Links)
+	sr.Workers = result.WorkerReports()
+	sr.Topology = SummarizeTopology(result.Neighbors, len(NodeArr))
+	s.Report.AddStep(sr)
+	s.Prev = result
+	s.First = step + 1
+	if CheckpointEvery > 0 && ((step+1)%CheckpointEvery == 0 || step == s.Steps-1) {
+		err := WriteCheckpoint(RunDir, &Checkpoint{
+			RunID:      s.RunID,
+			Seed:       Seed,
+			ConfigHash: s.ConfigHash,
+			Step:       step,
+			RngDraws:   RngDraws(),
+			Nodes:      NodeArr,
+			Prev:       &StepResult{Step: step, Neighbors: result.Neighbors, Load: result.Load},
+			Report:     s.Report,
+		})
+		if err != nil {
+			slog.Error("could not write checkpoint", "step", step, "err", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/LeBronQ/Mobility"
+	"github.com/LeBronQ/discovery"
+	"github.com/LeBronQ/tasks"
+	"github.com/LeBronQ/tasks/transport"
+	"github.com/LeBronQ/worker/simworker"
+)
+
+// channelFailures is the number of channel batch requests the stand-in
+// rejects before it answers again.
+var channelFailures atomic.Int64
+
+// standInMaxSpeed is the maximum speed of the generated nodes.
+const standInMaxSpeed = 20
+
+// standIns starts fakes of the mobility and channel model services. Nodes
+// walk inside the simulation area like the random walk of the mobility
+// service, with a velocity drawn from the request's seed in every time slot,
+// and link results are derived from the link's seed, so a run depends on
+// nothing but its seed.
+func standIns(tb testing.TB) (mobility *httptest.Server, channel *httptest.Server) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mobility/batch", func(w http.ResponseWriter, r *http.Request) {
+		var req MobilityBatchReqParams
+		json.NewDecoder(r.Body).Decode(&req)
+		for i := range req.Nodes {
+			n := &req.Nodes[i].Node
+			rng := rand.New(rand.NewSource(req.Nodes[i].Seed))
+			speed := rng.Float64() * standInMaxSpeed
+			a1, a2 := rng.Float64()*2*math.Pi, rng.Float64()*2*math.Pi
+			n.V.X = speed * math.Cos(a1) * math.Cos(a2)
+			n.V.Y = speed * math.Cos(a1) * math.Sin(a2)
+			n.V.Z = speed * math.Sin(a1)
+			next := Mobility.Position{
+				X: n.Pos.X + n.V.X*Mobility.TimeSlot,
+				Y: n.Pos.Y + n.V.Y*Mobility.TimeSlot,
+				Z: n.Pos.Z + n.V.Z*Mobility.TimeSlot,
+			}
+			n.Pos, n.V = Mobility.Nbox.BoundProcess(next, n.V, n.Pos)
+		}
+		json.NewEncoder(w).Encode(req)
+	})
+	mobility = httptest.NewServer(mux)
+	tb.Cleanup(mobility.Close)
+
+	mux = http.NewServeMux()
+	mux.HandleFunc("/model/batch", func(w http.ResponseWriter, r *http.Request) {
+		if channelFailures.Add(-1) >= 0 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var req simworker.ChannelBatchReqParams
+		json.NewDecoder(r.Body).Decode(&req)
+		res := simworker.ChannelBatchResult{Results: []tasks.LinkResult{}}
+		for _, l := range req.Links {
+			res.Results = append(res.Results, tasks.LinkResult{
+				LinkId: l.LinkId,
+				PLR:    float64(uint64(l.Seed)%1000) / 1000,
+			})
+		}
+		json.NewEncoder(w).Encode(res)
+	})
+	channel = httptest.NewServer(mux)
+	tb.Cleanup(channel.Close)
+	return mobility, channel
+}
+
+func instance(s *httptest.Server) []discovery.Instance {
+	return []discovery.Instance{{ID: s.URL, Address: strings.TrimPrefix(s.URL, "http://")}}
+}
+
+// runInProcess runs a seeded simulation of steps steps with the given
+// workers started in process. Workers listed in silent are handed work but
+// never serve it.
+func runInProcess(t *testing.T, steps int, workers int, silent ...int) *Simulation {
+	NodeNum = 60
+	Seed = 42
+	Rng.Seed(Seed)
+	NodeArr = GenerateNodes()
+	GraphFormats = []string{"json"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	sim := inProcess(ctx, t, transport.NewMemory(), steps, workers, silent...)
+	err := sim.Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sim
+}
+
+// inProcess prepares a simulation of NodeArr over steps steps against the
+// stand-in services, with the given workers started on mem until ctx is
+// done.
+func inProcess(ctx context.Context, tb testing.TB, mem *transport.Memory, steps int, workers int, silent ...int) *Simulation {
+	mob, ch := standIns(tb)
+	mobilityPool.SetInstances(instance(mob))
+	channelPool := discovery.NewPool("Default_ChannelModel", discovery.NewHTTPClient())
+	channelPool.SetInstances(instance(ch))
+	RunDir = tb.TempDir()
+	CheckpointEvery = 0
+
+	list := StartInProcessWorkers(ctx, mem, workers, channelPool)
+	for _, id := range silent {
+		list = append(list, discovery.Worker{ID: id, Queue: tasks.QueueName(id), Capacity: 1})
+	}
+
+	sim := &Simulation{
+		RunID:   "test",
+		Steps:   steps,
+		Report:  NewRunReport("test", Seed, steps),
+		Workers: func() ([]discovery.Worker, error) { return list, nil },
+	}
+	sim.Coord = NewCoordinator(sim.RunID, mem, NewWorkerMonitor(nil, HeartbeatTimeout), sim.Report)
+	return sim
+}
+
+func TestRunInProcess(t *testing.T) {
+	sim := runInProcess(t, 2, 3)
+	if sim.Report.StepsDone != 2 {
+		t.Fatalf("%d steps done, want 2", sim.Report.StepsDone)
+	}
+
+	// The neighbors of the last step are exactly the nodes in range of each
+	// node at the final positions, and every neighbor has a link.
+	links := 0
+	for _, n := range NodeArr {
+		want := []int64{}
+		for _, m := range NodeArr {
+			if m.ID != n.ID && Mobility.CalculateDistance3D(n.MobNode.Pos, m.MobNode.Pos) <= n.Range {
+				want = append(want, m.ID)
+			}
+		}
+		if got := sim.Prev.Neighbors[n.ID]; fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("node %d: neighbors %v, want %v", n.ID, got, want)
+		}
+		for _, m := range sim.Prev.Neighbors[n.ID] {
+			if _, ok := sim.Prev.Links[simworker.LinkID(n.ID, m, len(NodeArr))]; !ok {
+				t.Errorf("link %d->%d missing", n.ID, m)
+			}
+			links++
+		}
+	}
+	if links == 0 || links != len(sim.Prev.Links) {
+		t.Errorf("%d links for %d neighbors", len(sim.Prev.Links), links)
+	}
+}
+
+func TestRunInProcessIndependentOfWorkerNum(t *testing.T) {
+	tables := map[int][]byte{}
+	for _, workers := range []int{1, 4} {
+		runInProcess(t, 2, workers)
+		data, err := os.ReadFile(filepath.Join(RunDir, "links_step1.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tables[workers] = data
+	}
+	if string(tables[1]) != string(tables[4]) {
+		t.Error("link tables differ between 1 and 4 workers")
+	}
+}
+
+func TestRunInProcessWithCapacity(t *testing.T) {
+	defer func() { WorkerCapacity = 1 }()
+	tables := map[int][]byte{}
+	for _, capacity := range []int{1, 3} {
+		WorkerCapacity = capacity
+		sim := runInProcess(t, 2, 2)
+		if n := len(sim.Report.StepReports[1].Workers); n != 2 {
+			t.Errorf("capacity %d: %d workers reported", capacity, n)
+		}
+		data, err := os.ReadFile(filepath.Join(RunDir, "links_step1.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tables[capacity] = data
+	}
+	if string(tables[1]) != string(tables[3]) {
+		t.Error("link tables differ between capacity 1 and 3")
+	}
+}
+
+func TestRunInProcessRetriesFailedChannelRequests(t *testing.T) {
+	attempts := discovery.MaxAttempts
+	defer func() { discovery.MaxAttempts = attempts }()
+	discovery.MaxAttempts = 1
+
+	tables := map[int64][]byte{}
+	for _, failures := range []int64{0, 3} {
+		channelFailures.Store(failures)
+		sim := runInProcess(t, 1, 2)
+		// Failed tasks report their requests too, so every rejected
+		// request shows up as an error.
+		if got := sim.Report.Services["channel"].Errors; got != int(failures) {
+			t.Errorf("%d channel errors reported after %d failures", got, failures)
+		}
+		data, err := os.ReadFile(filepath.Join(RunDir, "links_step0.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tables[failures] = data
+	}
+	channelFailures.Store(0)
+	if string(tables[0]) != string(tables[3]) {
+		t.Error("link tables differ after failed channel requests")
+	}
+}
+
+func TestRunInProcessResumesFromCheckpoint(t *testing.T) {
+	const steps = 3
+	runInProcess(t, steps, 2)
+	want := readLinkTables(t, steps)
+
+	// Checkpoint the first step. The run goes on to store the results of
+	// the second but stops before checkpointing it.
+	Rng.Seed(Seed)
+	NodeArr = GenerateNodes()
+	ctx, cancel := context.WithCancel(context.Background())
+	mem := transport.NewMemory()
+	sim := inProcess(ctx, t, mem, 1, 2)
+	CheckpointEvery = 1
+	err := sim.Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := RunDir
+	sim.Steps = 2
+	CheckpointEvery = 0
+	err = sim.Run(ctx)
+	cancel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp, err := LoadCheckpoint(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Seed = cp.Seed
+	RestoreRng(Seed, cp.RngDraws)
+	NodeArr = cp.Nodes
+
+	// Resume as main does with --resume, now with a single worker, so the
+	// partitions of the second step have other sources than the results
+	// already stored for them.
+	ctx, cancel = context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	sim = inProcess(ctx, t, mem, steps, 1)
+	RunDir = dir
+	CheckpointEvery = 1
+	sim.Report = cp.Report
+	sim.Coord.Report = cp.Report
+	sim.Prev = cp.Prev
+	sim.First = cp.Step + 1
+	err = sim.Run(ctx)
+	CheckpointEvery = 0
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sim.Report.StepsDone != steps {
+		t.Fatalf("%d steps done, want %d", sim.Report.StepsDone, steps)
+	}
+	got := readLinkTables(t, steps)
+	for step := range want {
+		if string(got[step]) != string(want[step]) {
+			t.Errorf("step %d: resumed run differs from the uninterrupted one", step)
+		}
+	}
+}
+
+// readLinkTables reads the link tables of the first steps steps in RunDir.
+func readLinkTables(t *testing.T, steps int) [][]byte {
+	tables := make([][]byte, steps)
+	for step := range tables {
+		data, err := os.ReadFile(filepath.Join(RunDir, fmt.Sprintf("links_step%d.json", step)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tables[step] = data
+	}
+	return tables
+}
+
+func TestRunInProcessReassignsSilentWorker(t *testing.T) {
+	interval, timeout := HeartbeatInterval, HeartbeatTimeout
+	defer func() { HeartbeatInterval, HeartbeatTimeout = interval, timeout }()
+	HeartbeatInterval = 20 * time.Millisecond
+	HeartbeatTimeout = 200 * time.Millisecond
+
+	sim := runInProcess(t, 2, 2, 3)
+	if sim.Report.StepsDone != 2 {
+		t.Fatalf("%d steps done, want 2", sim.Report.StepsDone)
+	}
+	if len(sim.Report.Reassignments) == 0 {
+		t.Fatal("no partition was moved off the silent worker")
+	}
+	for _, ra := range sim.Report.Reassignments {
+		if ra.From != 3 {
+			t.Errorf("partition %d moved off live worker %d", ra.Partition, ra.From)
+		}
+	}
+}
+
+func TestRunInProcessWaitsForWorkers(t *testing.T) {
+	interval, timeout := HeartbeatInterval, BarrierTimeout
+	defer func() { HeartbeatInterval, BarrierTimeout = interval, timeout }()
+	HeartbeatInterval = 10 * time.Millisecond
+	BarrierTimeout = time.Minute
+
+	NodeNum = 20
+	Rng.Seed(Seed)
+	NodeArr = GenerateNodes()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sim := inProcess(ctx, t, transport.NewMemory(), 1, 2)
+	registered := sim.Workers
+	polls := 0
+	sim.Workers = func() ([]discovery.Worker, error) {
+		polls++
+		if polls <= 3 {
+			return nil, nil
+		}
+		return registered()
+	}
+	err := sim.Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if polls != 4 {
+		t.Errorf("workers listed %d times, want 4", polls)
+	}
+
+	BarrierTimeout = 50 * time.Millisecond
+	sim = inProcess(ctx, t, transport.NewMemory(), 1, 0)
+	err = sim.Run(ctx)
+	if err == nil || !strings.Contains(err.Error(), "no live workers") {
+		t.Errorf("run without workers: %v", err)
+	}
+}
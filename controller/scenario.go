@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/LeBronQ/Mobility"
+	"github.com/LeBronQ/RadioChannelModel"
+	"gopkg.in/yaml.v3"
+)
+
+// Scenario describes the node set of a run as groups of similar nodes.
+// Scenario files are YAML, or JSON when the file name ends in .json.
+type Scenario struct {
+	Name   string      `yaml:"name" json:"name"`
+	Groups []NodeGroup `yaml:"groups" json:"groups"`
+}
+
+type NodeGroup struct {
+	Name      string        `yaml:"name" json:"name"`
+	Count     int           `yaml:"count" json:"count"`
+	Placement PlacementSpec `yaml:"placement" json:"placement"`
+	Mobility  MobilitySpec  `yaml:"mobility" json:"mobility"`
+	Radio     WirelessNode  `yaml:"radio" json:"radio"`
+	Range     float64       `yaml:"range" json:"range"`
+	Channel   ChannelModel  `yaml:"channel" json:"channel"`
+}
+
+// PlacementSpec places the nodes of a group. Type is "random" (uniform in
+// the box spanned by Min and Max), "grid" (a regular lattice in that box) or
+// "explicit" (one entry of Positions per node).
+type PlacementSpec struct {
+	Type      string      `yaml:"type" json:"type"`
+	Min       []float64   `yaml:"min" json:"min"`
+	Max       []float64   `yaml:"max" json:"max"`
+	Positions [][]float64 `yaml:"positions" json:"positions"`
+}
+
+type MobilitySpec struct {
+	Model    string    `yaml:"model" json:"model"`
+	Velocity []float64 `yaml:"velocity" json:"velocity"`
+	Time     uint64    `yaml:"time" json:"time"`
+	MinSpeed float64   `yaml:"minspeed" json:"minspeed"`
+	MaxSpeed float64   `yaml:"maxspeed" json:"maxspeed"`
+}
+
+// LoadScenario reads and validates a scenario file.
+func LoadScenario(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sc := &Scenario{}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(data, sc)
+	} else {
+		err = yaml.Unmarshal(data, sc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse scenario %s: %v", path, err)
+	}
+	err = sc.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("scenario %s: %v", path, err)
+	}
+	return sc, nil
+}
+
+// Validate fills in defaults and checks that every group can be built.
+func (sc *Scenario) Validate() error {
+	if len(sc.Groups) == 0 {
+		return fmt.Errorf("no node groups")
+	}
+	for i := range sc.Groups {
+		g := &sc.Groups[i]
+		if g.Name == "" {
+			g.Name = fmt.Sprintf("group%d", i)
+		}
+		p := &g.Placement
+		if p.Type == "" {
+			p.Type = "random"
+		}
+		if p.Type == "explicit" && g.Count == 0 {
+			g.Count = len(p.Positions)
+		}
+		if g.Count <= 0 {
+			return fmt.Errorf("group %s: count must be positive", g.Name)
+		}
+		if p.Min == nil {
+			p.Min = []float64{BoxMin, BoxMin, BoxMin}
+		}
+		if p.Max == nil {
+			p.Max = []float64{BoxMax, BoxMax, BoxMax}
+		}
+		if len(p.Min) != 3 || len(p.Max) != 3 {
+			return fmt.Errorf("group %s: placement min and max need three coordinates", g.Name)
+		}
+		for d := 0; d < 3; d++ {
+			if p.Min[d] > p.Max[d] {
+				return fmt.Errorf("group %s: placement min %v above max %v", g.Name, p.Min, p.Max)
+			}
+		}
+		if !inBox(p.Min) || !inBox(p.Max) {
+			return fmt.Errorf("group %s: placement from %v to %v leaves the box %v..%v", g.Name, p.Min, p.Max, BoxMin, BoxMax)
+		}
+		switch p.Type {
+		case "random", "grid":
+		case "explicit":
+			if len(p.Positions) != g.Count {
+				return fmt.Errorf("group %s: %d positions for %d nodes", g.Name, len(p.Positions), g.Count)
+			}
+			for _, pos := range p.Positions {
+				if len(pos) != 3 {
+					return fmt.Errorf("group %s: position %v needs three coordinates", g.Name, pos)
+				}
+				if !inBox(pos) {
+					return fmt.Errorf("group %s: position %v outside the box %v..%v", g.Name, pos, BoxMin, BoxMax)
+				}
+			}
+		default:
+			return fmt.Errorf("group %s: unknown placement %q", g.Name, p.Type)
+		}
+		m := &g.Mobility
+		switch m.Model {
+		case "RandomWalk":
+			if m.MinSpeed > m.MaxSpeed {
+				return fmt.Errorf("group %s: minspeed above maxspeed", g.Name)
+			}
+		default:
+			return fmt.Errorf("group %s: unsupported mobility model %q", g.Name, m.Model)
+		}
+		if m.Velocity == nil {
+			m.Velocity = []float64{0, 0, 0}
+		}
+		if len(m.Velocity) != 3 {
+			return fmt.Errorf("group %s: velocity needs three components", g.Name)
+		}
+		if g.Range <= 0 {
+			return fmt.Errorf("group %s: range must be positive", g.Name)
+		}
+		if g.Channel.LargeScaleModel == "" || g.Channel.SmallScaleModel == "" {
+			return fmt.Errorf("group %s: channel models must be set", g.Name)
+		}
+	}
+	return nil
+}
+
+// inBox reports whether every coordinate of pos lies in BoxMin..BoxMax.
+func inBox(pos []float64) bool {
+	for _, c := range pos {
+		if c < BoxMin || c > BoxMax {
+			return false
+		}
+	}
+	return true
+}
+
+// NodeCount is the total number of nodes over all groups.
+func (sc *Scenario) NodeCount() int {
+	n := 0
+	for _, g := range sc.Groups {
+		n += g.Count
+	}
+	return n
+}
+
+// BuildNodes creates the nodes of all groups in order, numbering them from 0.
+func (sc *Scenario) BuildNodes(rng *rand.Rand) []*Node {
+	arr := make([]*Node, 0, sc.NodeCount())
+	for _, g := range sc.Groups {
+		for i := 0; i < g.Count; i++ {
+			id := int64(len(arr))
+			node := Mobility.Node{
+				ID:    id,
+				Pos:   g.Placement.position(i, g.Count, rng),
+				Time:  g.Mobility.Time,
+				V:     Mobility.Speed{X: g.Mobility.Velocity[0], Y: g.Mobility.Velocity[1], Z: g.Mobility.Velocity[2]},
+				Model: g.Mobility.Model,
+				Param: Mobility.RandomWalkParam{
+					MinSpeed: g.Mobility.MinSpeed,
+					MaxSpeed: g.Mobility.MaxSpeed,
+				},
+			}
+			arr = append(arr, &Node{
+				ID:      id,
+				MobNode: node,
+				WNode:   RadioChannelModel.WirelessNode(g.Radio),
+				Range:   g.Range,
+				Channel: g.Channel,
+			})
+		}
+	}
+	return arr
+}
+
+func (p PlacementSpec) position(i int, count int, rng *rand.Rand) Mobility.Position {
+	switch p.Type {
+	case "explicit":
+		return Mobility.Position{X: p.Positions[i][0], Y: p.Positions[i][1], Z: p.Positions[i][2]}
+	case "grid":
+		side := int(math.Ceil(math.Cbrt(float64(count))))
+		idx := []int{i % side, (i / side) % side, i / (side * side)}
+		c := make([]float64, 3)
+		for d := 0; d < 3; d++ {
+			c[d] = p.Min[d] + (float64(idx[d])+0.5)*(p.Max[d]-p.Min[d])/float64(side)
+		}
+		return Mobility.Position{X: c[0], Y: c[1], Z: c[2]}
+	default:
+		return Mobility.Position{
+			X: p.Min[0] + rng.Float64()*(p.Max[0]-p.Min[0]),
+			Y: p.Min[1] + rng.Float64()*(p.Max[1]-p.Min[1]),
+			Z: p.Min[2] + rng.Float64()*(p.Max[2]-p.Min[2]),
+		}
+	}
+}
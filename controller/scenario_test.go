@@ -0,0 +1,143 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testGroupYAML = `
+    mobility: {model: RandomWalk, minspeed: 0, maxspeed: 20}
+    radio: {frequency: 2.4e+9, bitrate: 5.0e+7, modulation: BPSK, bandwidth: 2.0e+7, m: 0, powerindbm: 20}
+    range: 500
+    channel: {largescalemodel: FreeSpacePathLossModel, smallscalemodel: NakagamiFadingModel}
+`
+
+func writeScenario(t *testing.T, name string, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadScenarioYAML(t *testing.T) {
+	sc, err := LoadScenario(writeScenario(t, "s.yaml", `
+name: test
+groups:
+  - count: 8
+`+testGroupYAML+`
+  - name: fixed
+    placement:
+      type: explicit
+      positions: [[0, 0, 0], [4000, 4000, 4000]]
+`+testGroupYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.Name != "test" || sc.NodeCount() != 10 {
+		t.Fatalf("scenario %q with %d nodes, want test with 10", sc.Name, sc.NodeCount())
+	}
+	g := sc.Groups[0]
+	if g.Name != "group0" || g.Placement.Type != "random" {
+		t.Errorf("defaults: name %q, placement %q", g.Name, g.Placement.Type)
+	}
+	if len(g.Placement.Min) != 3 || g.Placement.Min[0] != BoxMin || g.Placement.Max[2] != BoxMax {
+		t.Errorf("default placement box %v..%v", g.Placement.Min, g.Placement.Max)
+	}
+	if len(g.Mobility.Velocity) != 3 {
+		t.Errorf("default velocity %v", g.Mobility.Velocity)
+	}
+	if g.Radio.Modulation != "BPSK" || g.Radio.PowerInDbm != 20 || g.Channel.SmallScaleModel != "NakagamiFadingModel" {
+		t.Errorf("radio %+v, channel %+v", g.Radio, g.Channel)
+	}
+	if sc.Groups[1].Count != 2 {
+		t.Errorf("explicit group counts %d nodes, want 2", sc.Groups[1].Count)
+	}
+
+	nodes := sc.BuildNodes(Rng)
+	for i, n := range nodes {
+		if n.ID != int64(i) || n.Range != 500 {
+			t.Errorf("node %d: ID %d, range %v", i, n.ID, n.Range)
+		}
+	}
+	if p := nodes[9].MobNode.Pos; p.X != 4000 || p.Y != 4000 || p.Z != 4000 {
+		t.Errorf("explicit node at %v", p)
+	}
+}
+
+func TestLoadScenarioJSON(t *testing.T) {
+	sc, err := LoadScenario(writeScenario(t, "s.json", `{
+		"name": "json",
+		"groups": [{
+			"count": 27,
+			"placement": {"type": "grid", "min": [0, 0, 0], "max": [300, 300, 300]},
+			"mobility": {"model": "RandomWalk", "maxspeed": 10},
+			"radio": {"modulation": "QAM", "m": 16},
+			"range": 100,
+			"channel": {"largescalemodel": "FreeSpacePathLossModel", "smallscalemodel": "NakagamiFadingModel"}
+		}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := sc.BuildNodes(Rng)
+	if len(nodes) != 27 || nodes[0].WNode.M != 16 {
+		t.Fatalf("%d nodes, first with m %v", len(nodes), nodes[0].WNode.M)
+	}
+	if p := nodes[26].MobNode.Pos; p.X != 250 || p.Y != 250 || p.Z != 250 {
+		t.Errorf("last grid node at %v, want 250,250,250", p)
+	}
+}
+
+func TestLoadScenarioInvalid(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		group string
+		want  string
+	}{
+		{"no count", "  - name: g\n", "count must be positive"},
+		{"placement type", "  - count: 1\n    placement: {type: circle}\n", "unknown placement"},
+		{"short min", "  - count: 1\n    placement: {min: [0, 0]}\n", "three coordinates"},
+		{"min above max", "  - count: 1\n    placement: {min: [100, 0, 0], max: [50, 10, 10]}\n", "above max"},
+		{"random outside box", "  - count: 1\n    placement: {min: [-10, 0, 0], max: [10, 10, 10]}\n", "leaves the box"},
+		{"grid outside box", "  - count: 1\n    placement: {type: grid, min: [0, 0, 0], max: [5000, 10, 10]}\n", "leaves the box"},
+		{"explicit count", "  - count: 2\n    placement: {type: explicit, positions: [[0, 0, 0]]}\n", "1 positions for 2 nodes"},
+		{"explicit short", "  - placement: {type: explicit, positions: [[0, 0]]}\n", "three coordinates"},
+		{"explicit outside box", "  - placement: {type: explicit, positions: [[0, 0, 4001]]}\n", "outside the box"},
+		{"mobility model", "  - count: 1\n    mobility: {model: Teleport}\n    range: 1\n", "unsupported mobility model"},
+		{"speeds", "  - count: 1\n    mobility: {model: RandomWalk, minspeed: 5, maxspeed: 1}\n", "minspeed above maxspeed"},
+		{"velocity", "  - count: 1\n    mobility: {model: RandomWalk, velocity: [1, 2]}\n", "velocity needs three"},
+		{"range", "  - count: 1\n    mobility: {model: RandomWalk}\n", "range must be positive"},
+		{"channel", "  - count: 1\n    mobility: {model: RandomWalk}\n    range: 1\n", "channel models must be set"},
+	} {
+		_, err := LoadScenario(writeScenario(t, "s.yaml", "groups:\n"+c.group))
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: %v, want an error containing %q", c.name, err, c.want)
+		}
+	}
+	_, err := LoadScenario(writeScenario(t, "s.yaml", "name: empty\n"))
+	if err == nil || !strings.Contains(err.Error(), "no node groups") {
+		t.Errorf("empty scenario: %v", err)
+	}
+	_, err = LoadScenario(writeScenario(t, "s.json", "groups: []"))
+	if err == nil || !strings.Contains(err.Error(), "parse scenario") {
+		t.Errorf("YAML in a .json file: %v", err)
+	}
+}
+
+func TestLoadScenarioFiles(t *testing.T) {
+	paths, _ := filepath.Glob("../scenarios/*.yaml")
+	if len(paths) == 0 {
+		t.Fatal("no scenario files")
+	}
+	for _, path := range paths {
+		_, err := LoadScenario(path)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+// Package discovery finds model service instances in Consul and spreads
+// requests over them.
+package discovery
+
+import (
+	"net"
+	"strconv"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// Instance is one instance of a service.
+type Instance struct {
+	ID      string
+	Address string
+}
+
+// URL is the address of path on the instance.
+func (i Instance) URL(path string) string {
+	return "http://" + i.Address + path
+}
+
+func instancesOf(entries []*consulapi.ServiceEntry) []Instance {
+	instances := make([]Instance, 0, len(entries))
+	for _, se := range entries {
+		host := se.Service.Address
+		if host == "" {
+			host = se.Node.Address
+		}
+		instances = append(instances, Instance{
+			ID:      se.Service.ID,
+			Address: net.JoinHostPort(host, strconv.Itoa(se.Service.Port)),
+		})
+	}
+	return instances
+}
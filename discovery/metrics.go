@@ -0,0 +1,41 @@
+package discovery
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sim_service_request_duration_seconds",
+		Help:    "Latency of single requests to the model services.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"service", "path"})
+	requestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sim_service_request_errors_total",
+		Help: "Failed requests to the model services by status code, or \"unavailable\" when no instance could be used and \"error\" for any other failure.",
+	}, []string{"service", "code"})
+)
+
+// observe records the outcome of one request of p started at start.
+func (p *Pool) observe(path string, start time.Time, err error) {
+	requestDuration.WithLabelValues(p.Name, path).Observe(time.Since(start).Seconds())
+	if err != nil {
+		requestErrors.WithLabelValues(p.Name, errorCode(err)).Inc()
+	}
+}
+
+func errorCode(err error) string {
+	var se *StatusError
+	switch {
+	case errors.As(err, &se):
+		return strconv.Itoa(se.Code)
+	case errors.Is(err, ErrNoInstances), errors.Is(err, ErrAllOpen):
+		return "unavailable"
+	}
+	return "error"
+}
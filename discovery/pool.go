@@ -0,0 +1,337 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Retry and circuit breaker settings shared by all pools.
+var (
+	MaxAttempts      = 3
+	RetryBackoff     = 100 * time.Millisecond
+	MaxBackoff       = 2 * time.Second
+	BreakerThreshold = 5
+	BreakerCooldown  = 30 * time.Second
+)
+
+// Configure reads the retry and circuit breaker settings from the
+// ServiceMaxAttempts, ServiceRetryBackoff, ServiceBreakerThreshold and
+// ServiceBreakerCooldown keys of v.
+func Configure(v *viper.Viper) {
+	if v.IsSet("ServiceMaxAttempts") {
+		MaxAttempts = max(1, v.GetInt("ServiceMaxAttempts"))
+	}
+	if v.IsSet("ServiceRetryBackoff") {
+		RetryBackoff = v.GetDuration("ServiceRetryBackoff")
+	}
+	if v.IsSet("ServiceBreakerThreshold") {
+		BreakerThreshold = max(1, v.GetInt("ServiceBreakerThreshold"))
+	}
+	if v.IsSet("ServiceBreakerCooldown") {
+		BreakerCooldown = v.GetDuration("ServiceBreakerCooldown")
+	}
+}
+
+var (
+	ErrNoInstances = errors.New("no passing instances")
+	ErrAllOpen     = errors.New("circuit open on every instance")
+)
+
+// StatusError is returned for a model service answer other than 200 OK.
+type StatusError struct {
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status code: %d", e.Code)
+}
+
+// BatchUnsupported reports whether err means the service has no batch
+// endpoint.
+func BatchUnsupported(err error) bool {
+	var se *StatusError
+	if !errors.As(err, &se) {
+		return false
+	}
+	return se.Code == http.StatusNotFound || se.Code == http.StatusMethodNotAllowed || se.Code == http.StatusNotImplemented
+}
+
+// BatchFallback sends batch requests to a service until the service answers
+// one as unknown, and single requests from then on.
+type BatchFallback struct {
+	// Service names the service in the log.
+	Service string
+
+	unsupported atomic.Bool
+}
+
+// Do runs batch while the service supports batches, and single once it does
+// not. An error of batch that does not satisfy BatchUnsupported is returned
+// without falling back.
+func (f *BatchFallback) Do(batch func() error, single func() error) error {
+	if !f.unsupported.Load() {
+		err := batch()
+		if !BatchUnsupported(err) {
+			return err
+		}
+		if f.unsupported.CompareAndSwap(false, true) {
+			slog.Info("service has no batch endpoint, falling back to single requests", "service", f.Service)
+		}
+	}
+	return single()
+}
+
+// retryable reports whether a failed request may succeed on another
+// instance. Transport and decoding errors, 429 and 5xx answers count
+// against the instance; any other answer means the instance works and the
+// request is at fault.
+func retryable(err error) bool {
+	var se *StatusError
+	if !errors.As(err, &se) {
+		return true
+	}
+	return se.Code == http.StatusTooManyRequests || se.Code >= 500
+}
+
+type instanceState struct {
+	Instance
+	inflight  int
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func (s *instanceState) open() bool {
+	return s.failures >= BreakerThreshold
+}
+
+// CallCounter counts the attempts Post makes for requests whose context
+// carries the counter, and the attempts that failed. Retries count as
+// attempts of their own; answers of BatchUnsupported do not count as
+// failures.
+type CallCounter struct {
+	attempts atomic.Int64
+	errors   atomic.Int64
+}
+
+type callCounterKey struct{}
+
+// WithCallCounter returns a context that counts the attempts of requests on
+// c.
+func WithCallCounter(ctx context.Context, c *CallCounter) context.Context {
+	return context.WithValue(ctx, callCounterKey{}, c)
+}
+
+// Counts returns the attempts made so far and how many of them failed.
+func (c *CallCounter) Counts() (attempts int, errors int) {
+	return int(c.attempts.Load()), int(c.errors.Load())
+}
+
+func (c *CallCounter) count(err error) {
+	c.attempts.Add(1)
+	if err != nil && !BatchUnsupported(err) {
+		c.errors.Add(1)
+	}
+}
+
+// Pool sends requests to the instances of one service. Each request goes to
+// the instance with the fewest requests in flight, taking turns among equals.
+// A request that fails is retried on another instance after an exponential
+// backoff. An instance that fails BreakerThreshold requests in a row gets no
+// requests for BreakerCooldown; then a single trial request decides whether
+// it is used again.
+type Pool struct {
+	Name   string
+	Client *http.Client
+
+	mu        sync.Mutex
+	instances []*instanceState
+	next      int
+}
+
+func NewPool(name string, client *http.Client) *Pool {
+	return &Pool{
+		Name:   name,
+		Client: client,
+	}
+}
+
+// NewHTTPClient returns a client for a pool that keeps connections to the
+// instances alive between requests.
+func NewHTTPClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			MaxIdleConns:        100,
+			MaxIdleConnsPerHost: 100,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		Timeout: 30 * time.Second,
+	}
+}
+
+// SetInstances replaces the instance list. Instances that stay keep their
+// breaker state.
+func (p *Pool) SetInstances(instances []Instance) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	old := make(map[string]*instanceState, len(p.instances))
+	for _, s := range p.instances {
+		old[s.ID] = s
+	}
+	states := make([]*instanceState, 0, len(instances))
+	for _, in := range instances {
+		s, ok := old[in.ID]
+		if !ok {
+			s = &instanceState{}
+		}
+		s.Instance = in
+		states = append(states, s)
+	}
+	p.instances = states
+}
+
+// Instances returns the current instance list.
+func (p *Pool) Instances() []Instance {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	instances := make([]Instance, len(p.instances))
+	for i, s := range p.instances {
+		instances[i] = s.Instance
+	}
+	return instances
+}
+
+// acquire picks the instance for the next attempt, preferring instances not
+// tried yet.
+func (p *Pool) acquire(tried map[string]bool) (*instanceState, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.instances) == 0 {
+		return nil, ErrNoInstances
+	}
+	now := time.Now()
+	var best *instanceState
+	bestTried := false
+	for k := 0; k < len(p.instances); k++ {
+		s := p.instances[(p.next+k)%len(p.instances)]
+		if s.open() && (s.probing || now.Before(s.openUntil)) {
+			continue
+		}
+		if best == nil || (bestTried && !tried[s.ID]) || (bestTried == tried[s.ID] && s.inflight < best.inflight) {
+			best, bestTried = s, tried[s.ID]
+		}
+	}
+	if best == nil {
+		return nil, ErrAllOpen
+	}
+	p.next = (p.next + 1) % len(p.instances)
+	if best.open() {
+		best.probing = true
+	}
+	best.inflight++
+	return best, nil
+}
+
+func (p *Pool) release(s *instanceState, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s.inflight--
+	s.probing = false
+	if err != nil && retryable(err) {
+		s.failures++
+		if s.open() {
+			s.openUntil = time.Now().Add(BreakerCooldown)
+			slog.Warn("circuit open", "service", p.Name, "instance", s.Address, "cooldown", BreakerCooldown, "failures", s.failures, "err", err)
+		}
+		return
+	}
+	if s.open() {
+		slog.Info("circuit closed", "service", p.Name, "instance", s.Address)
+	}
+	s.failures = 0
+}
+
+// Post sends in as JSON to path and decodes the answer into out. The trace
+// context of ctx is passed on in the request headers.
+func (p *Pool) Post(ctx context.Context, path string, in interface{}, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return fmt.Errorf("error encoding JSON: %v", err)
+	}
+	counter, _ := ctx.Value(callCounterKey{}).(*CallCounter)
+	tried := map[string]bool{}
+	backoff := RetryBackoff
+	for attempt := 1; ; attempt++ {
+		s, aerr := p.acquire(tried)
+		if aerr == nil {
+			tried[s.ID] = true
+			start := time.Now()
+			err = p.post(ctx, s.URL(path), body, out)
+			p.observe(path, start, err)
+			p.release(s, err)
+		} else {
+			err = aerr
+			requestErrors.WithLabelValues(p.Name, errorCode(err)).Inc()
+		}
+		if counter != nil {
+			counter.count(err)
+		}
+		if aerr == nil && (err == nil || !retryable(err)) {
+			return err
+		}
+		if attempt >= MaxAttempts {
+			return fmt.Errorf("%s: giving up after %d attempts: %w", p.Name, attempt, err)
+		}
+		wait := time.NewTimer(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)))
+		select {
+		case <-wait.C:
+		case <-ctx.Done():
+			wait.Stop()
+			return fmt.Errorf("%s: %w after %d attempts, last error: %v", p.Name, ctx.Err(), attempt, err)
+		}
+		backoff = min(2*backoff, MaxBackoff)
+	}
+}
+
+func (p *Pool) post(ctx context.Context, url string, body []byte, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return &StatusError{Code: resp.StatusCode}
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading response body: %v", err)
+	}
+	err = json.Unmarshal(data, out)
+	if err != nil {
+		return fmt.Errorf("error decoding response: %v", err)
+	}
+	return nil
+}
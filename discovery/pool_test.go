@@ -0,0 +1,223 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testPool(ids ...string) *Pool {
+	p := NewPool("test", http.DefaultClient)
+	instances := make([]Instance, len(ids))
+	for i, id := range ids {
+		instances[i] = Instance{ID: id, Address: id}
+	}
+	p.SetInstances(instances)
+	return p
+}
+
+func mustAcquire(t *testing.T, p *Pool, tried map[string]bool) *instanceState {
+	t.Helper()
+	s, err := p.acquire(tried)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestAcquireLeastOutstanding(t *testing.T) {
+	p := testPool("a", "b", "c")
+	busy := mustAcquire(t, p, nil)
+	seen := map[string]bool{busy.ID: true}
+	for i := 0; i < 2; i++ {
+		s := mustAcquire(t, p, nil)
+		if seen[s.ID] {
+			t.Fatalf("instance %s picked again while others are idle", s.ID)
+		}
+		seen[s.ID] = true
+	}
+	p.release(busy, nil)
+	if s := mustAcquire(t, p, nil); s != busy {
+		t.Errorf("picked %s, want the idle instance %s", s.ID, busy.ID)
+	}
+}
+
+func TestAcquirePrefersUntried(t *testing.T) {
+	p := testPool("a", "b")
+	b := p.instances[1]
+	b.inflight = 5
+	s := mustAcquire(t, p, map[string]bool{"a": true})
+	if s != b {
+		t.Errorf("picked %s, want the untried instance b", s.ID)
+	}
+	s = mustAcquire(t, p, map[string]bool{"a": true, "b": true})
+	if s.ID != "a" {
+		t.Errorf("picked %s among tried instances, want the less loaded a", s.ID)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	threshold, cooldown := BreakerThreshold, BreakerCooldown
+	defer func() { BreakerThreshold, BreakerCooldown = threshold, cooldown }()
+	BreakerThreshold = 2
+	BreakerCooldown = time.Hour
+
+	p := testPool("a")
+	for i := 0; i < BreakerThreshold; i++ {
+		p.release(mustAcquire(t, p, nil), &StatusError{Code: http.StatusBadRequest})
+	}
+	if p.instances[0].open() {
+		t.Fatal("circuit opened on answers that are not the instance's fault")
+	}
+	for i := 0; i < BreakerThreshold; i++ {
+		p.release(mustAcquire(t, p, nil), &StatusError{Code: http.StatusServiceUnavailable})
+	}
+	if _, err := p.acquire(nil); !errors.Is(err, ErrAllOpen) {
+		t.Fatalf("acquire on an open circuit: %v, want ErrAllOpen", err)
+	}
+
+	// After the cooldown one trial request is let through at a time.
+	p.instances[0].openUntil = time.Now()
+	probe := mustAcquire(t, p, nil)
+	if _, err := p.acquire(nil); !errors.Is(err, ErrAllOpen) {
+		t.Fatalf("second request during the trial: %v, want ErrAllOpen", err)
+	}
+	p.release(probe, errors.New("connection refused"))
+	if _, err := p.acquire(nil); !errors.Is(err, ErrAllOpen) {
+		t.Fatalf("acquire after a failed trial: %v, want ErrAllOpen", err)
+	}
+
+	p.instances[0].openUntil = time.Now()
+	p.release(mustAcquire(t, p, nil), nil)
+	if p.instances[0].open() {
+		t.Fatal("circuit still open after a successful trial")
+	}
+	mustAcquire(t, p, nil)
+}
+
+func TestSetInstancesKeepsBreakerState(t *testing.T) {
+	p := testPool("a", "b")
+	p.instances[0].failures = 3
+	p.SetInstances([]Instance{{ID: "a", Address: "a2"}, {ID: "c", Address: "c"}})
+	if len(p.instances) != 2 || p.instances[0].failures != 3 || p.instances[0].Address != "a2" {
+		t.Errorf("instance a lost its state: %+v", p.instances[0])
+	}
+	if p.instances[1].failures != 0 {
+		t.Errorf("new instance c starts with %d failures", p.instances[1].failures)
+	}
+}
+
+func TestPostStopsBackoffOnCancel(t *testing.T) {
+	attempts, backoff := MaxAttempts, RetryBackoff
+	defer func() { MaxAttempts, RetryBackoff = attempts, backoff }()
+	MaxAttempts = 10
+	RetryBackoff = time.Hour
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer s.Close()
+	p := NewPool("test", s.Client())
+	p.SetInstances([]Instance{{ID: "s", Address: strings.TrimPrefix(s.URL, "http://")}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan error)
+	go func() { done <- p.Post(ctx, "/", struct{}{}, &struct{}{}) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Post: %v, want the context error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Post kept backing off after the context was done")
+	}
+}
+
+func TestBatchUnsupported(t *testing.T) {
+	for code, want := range map[int]bool{
+		http.StatusNotFound:            true,
+		http.StatusMethodNotAllowed:    true,
+		http.StatusNotImplemented:      true,
+		http.StatusBadRequest:          false,
+		http.StatusServiceUnavailable:  false,
+		http.StatusInternalServerError: false,
+	} {
+		if got := BatchUnsupported(&StatusError{Code: code}); got != want {
+			t.Errorf("BatchUnsupported(%d) = %v, want %v", code, got, want)
+		}
+	}
+	if BatchUnsupported(errors.New("connection refused")) {
+		t.Error("a transport error counts as a missing batch endpoint")
+	}
+}
+
+func TestBatchFallback(t *testing.T) {
+	var f BatchFallback
+	batches, singles := 0, 0
+	batch := func(err error) func() error {
+		return func() error {
+			batches++
+			return err
+		}
+	}
+	single := func() error {
+		singles++
+		return nil
+	}
+
+	failed := &StatusError{Code: http.StatusServiceUnavailable}
+	if err := f.Do(batch(failed), single); err != failed {
+		t.Errorf("failed batch: %v, want %v", err, failed)
+	}
+	if err := f.Do(batch(nil), single); err != nil || batches != 2 || singles != 0 {
+		t.Fatalf("batches %d, singles %d, err %v after a working batch", batches, singles, err)
+	}
+	f.Do(batch(&StatusError{Code: http.StatusNotFound}), single)
+	f.Do(batch(nil), single)
+	if batches != 3 || singles != 2 {
+		t.Errorf("batches %d, singles %d after a missing batch endpoint, want 3 and 2", batches, singles)
+	}
+}
+
+func TestPostCountsAttempts(t *testing.T) {
+	backoff := RetryBackoff
+	defer func() { RetryBackoff = backoff }()
+	RetryBackoff = time.Millisecond
+
+	failures := 2
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/batch":
+			w.WriteHeader(http.StatusNotFound)
+		case failures > 0:
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte("{}"))
+		}
+	}))
+	defer s.Close()
+	p := NewPool("test", s.Client())
+	p.SetInstances([]Instance{{ID: "s", Address: strings.TrimPrefix(s.URL, "http://")}})
+
+	c := &CallCounter{}
+	ctx := WithCallCounter(context.Background(), c)
+	if err := p.Post(ctx, "/batch", struct{}{}, &struct{}{}); !BatchUnsupported(err) {
+		t.Fatalf("batch: %v", err)
+	}
+	if err := p.Post(ctx, "/", struct{}{}, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if attempts, errs := c.Counts(); attempts != 4 || errs != 2 {
+		t.Errorf("%d attempts with %d errors, want 4 with 2", attempts, errs)
+	}
+	p.Post(context.Background(), "/", struct{}{}, &struct{}{})
+	if attempts, _ := c.Counts(); attempts != 4 {
+		t.Errorf("request without the counter counted, %d attempts", attempts)
+	}
+}
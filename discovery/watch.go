@@ -0,0 +1,177 @@
+package discovery
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// Settings of the blocking queries watchers issue.
+var (
+	WatchWaitTime   = 5 * time.Minute
+	WatchMaxBackoff = 30 * time.Second
+)
+
+// Event reports a change in the passing instances of a service. The first
+// event of a watch lists every instance as added.
+type Event struct {
+	Service   string
+	Instances []Instance
+	Added     []Instance
+	Removed   []Instance
+}
+
+func addresses(instances []Instance) []string {
+	addrs := make([]string, len(instances))
+	for i, in := range instances {
+		addrs[i] = in.Address
+	}
+	return addrs
+}
+
+// Watcher follows the passing instances of one service with Consul blocking
+// queries.
+type Watcher struct {
+	Service string
+
+	health *consulapi.Health
+}
+
+func NewWatcher(consulAddress string, service string) (*Watcher, error) {
+	config := consulapi.DefaultConfig()
+	config.Address = consulAddress
+	client, err := consulapi.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Watcher{Service: service, health: client.Health()}, nil
+}
+
+// Run sends an event on events whenever the passing instances change, until
+// ctx is done. Failed queries are retried with a growing delay; meanwhile
+// the last known instances stay in effect. errs, if not nil, receives the
+// error of every failed query.
+func (w *Watcher) Run(ctx context.Context, events chan<- Event, errs chan<- error) {
+	var index uint64
+	var current []Instance
+	first := true
+	backoff := time.Second
+	for ctx.Err() == nil {
+		opts := (&consulapi.QueryOptions{WaitIndex: index, WaitTime: WatchWaitTime}).WithContext(ctx)
+		entries, meta, err := w.health.Service(w.Service, "", true, opts)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if errs != nil {
+				select {
+				case errs <- err:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			backoff = min(2*backoff, WatchMaxBackoff)
+			continue
+		}
+		backoff = time.Second
+		// A lower index means the Consul state was reset.
+		if meta.LastIndex < index {
+			index = 0
+		} else {
+			index = meta.LastIndex
+		}
+		instances := instancesOf(entries)
+		sort.Slice(instances, func(i, j int) bool { return instances[i].ID < instances[j].ID })
+		added, removed := diffInstances(current, instances)
+		if !first && len(added) == 0 && len(removed) == 0 {
+			continue
+		}
+		first = false
+		current = instances
+		select {
+		case events <- Event{Service: w.Service, Instances: instances, Added: added, Removed: removed}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// diffInstances returns the instances of next not in prev and those of prev
+// not in next. An instance that moved to another address is in both.
+func diffInstances(prev []Instance, next []Instance) (added []Instance, removed []Instance) {
+	inPrev := make(map[Instance]bool, len(prev))
+	for _, in := range prev {
+		inPrev[in] = true
+	}
+	inNext := make(map[Instance]bool, len(next))
+	for _, in := range next {
+		inNext[in] = true
+		if !inPrev[in] {
+			added = append(added, in)
+		}
+	}
+	for _, in := range prev {
+		if !inNext[in] {
+			removed = append(removed, in)
+		}
+	}
+	return added, removed
+}
+
+// Follow keeps the instances of every pool current for as long as ctx lasts
+// and logs each change. Pools are named after their service. Follow returns
+// once each pool has its first instance list or its first query has failed;
+// the error of that query is returned, and the watch goes on regardless.
+func Follow(ctx context.Context, consulAddress string, pools ...*Pool) error {
+	var firstErr error
+	for _, p := range pools {
+		w, err := NewWatcher(consulAddress, p.Name)
+		if err != nil {
+			return err
+		}
+		events := make(chan Event)
+		errs := make(chan error)
+		go w.Run(ctx, events, errs)
+
+		select {
+		case ev := <-events:
+			p.Apply(ev)
+		case err := <-errs:
+			if firstErr == nil {
+				firstErr = err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		go func(p *Pool) {
+			for {
+				select {
+				case ev := <-events:
+					p.Apply(ev)
+				case err := <-errs:
+					slog.Warn("discovery failed", "service", p.Name, "err", err)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(p)
+	}
+	return firstErr
+}
+
+// Apply logs a change of instances and puts it into effect.
+func (p *Pool) Apply(ev Event) {
+	slog.Info("instances changed", "service", ev.Service, "passing", len(ev.Instances), "added", addresses(ev.Added), "removed", addresses(ev.Removed))
+	if len(ev.Instances) == 0 {
+		slog.Warn("no passing instances, requests will fail until one appears", "service", ev.Service)
+	}
+	p.SetInstances(ev.Instances)
+}
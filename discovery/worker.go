@@ -0,0 +1,133 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// WorkerService is the Consul service simulation workers register as.
+const WorkerService = "simulation-worker"
+
+// DeregisterAfter is how long a worker may fail its health check before
+// Consul drops its registration.
+var DeregisterAfter = time.Minute
+
+// Worker describes a registered simulation worker: the asynq queue it serves
+// and the number of tasks it runs at a time.
+type Worker struct {
+	ID       int
+	Queue    string
+	Capacity int
+}
+
+// Registration is the Consul registration of one worker. Its health check
+// passes for a TTL at a time and has to be renewed with Pass.
+type Registration struct {
+	ServiceID string
+
+	agent   *consulapi.Agent
+	checkID string
+}
+
+// RegisterWorker registers w with the Consul agent at consulAddress. The
+// health check starts out passing and turns critical unless passed again
+// within ttl.
+func RegisterWorker(consulAddress string, w Worker, ttl time.Duration) (*Registration, error) {
+	config := consulapi.DefaultConfig()
+	config.Address = consulAddress
+	client, err := consulapi.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	r := &Registration{
+		ServiceID: fmt.Sprintf("%s-%d", WorkerService, w.ID),
+		agent:     client.Agent(),
+	}
+	r.checkID = r.ServiceID + ":ttl"
+	err = r.agent.ServiceRegister(&consulapi.AgentServiceRegistration{
+		ID:      r.ServiceID,
+		Name:    WorkerService,
+		Address: host,
+		Meta: map[string]string{
+			"worker_id": strconv.Itoa(w.ID),
+			"queue":     w.Queue,
+			"capacity":  strconv.Itoa(w.Capacity),
+		},
+		Check: &consulapi.AgentServiceCheck{
+			CheckID:                        r.checkID,
+			TTL:                            ttl.String(),
+			Status:                         consulapi.HealthPassing,
+			DeregisterCriticalServiceAfter: DeregisterAfter.String(),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Pass renews the health check.
+func (r *Registration) Pass() error {
+	return r.agent.UpdateTTL(r.checkID, "", consulapi.HealthPassing)
+}
+
+// KeepAlive renews the health check every interval until ctx is done.
+func (r *Registration) KeepAlive(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := r.Pass()
+		if err != nil {
+			slog.Warn("consul health check update failed", "service", r.ServiceID, "err", err)
+		}
+	}
+}
+
+// Deregister removes the worker from Consul.
+func (r *Registration) Deregister() error {
+	return r.agent.ServiceDeregister(r.ServiceID)
+}
+
+// Workers returns the registered workers whose health checks pass, ordered
+// by ID. Registrations with unusable metadata are reported and left out.
+func Workers(consulAddress string) ([]Worker, error) {
+	config := consulapi.DefaultConfig()
+	config.Address = consulAddress
+	client, err := consulapi.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	entries, _, err := client.Health().Service(WorkerService, "", true, nil)
+	if err != nil {
+		return nil, err
+	}
+	workers := make([]Worker, 0, len(entries))
+	for _, se := range entries {
+		meta := se.Service.Meta
+		id, err := strconv.Atoi(meta["worker_id"])
+		if err != nil || id < 1 || meta["queue"] == "" {
+			slog.Warn("ignoring worker registration", "id", se.Service.ID, "meta", meta)
+			continue
+		}
+		capacity, err := strconv.Atoi(meta["capacity"])
+		if err != nil || capacity < 1 {
+			capacity = 1
+		}
+		workers = append(workers, Worker{ID: id, Queue: meta["queue"], Capacity: capacity})
+	}
+	sort.Slice(workers, func(i, j int) bool { return workers[i].ID < workers[j].ID })
+	return workers, nil
+}
@@ -0,0 +1,68 @@
+// Package logging sets up the structured logger shared by the controller,
+// the workers and boot.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+var (
+	// Level is the lowest level logged: debug, info, warn or error.
+	Level = "info"
+	// Format is text for key=value lines or json for one JSON object per
+	// line.
+	Format = "text"
+)
+
+// Configure reads Level and Format from the LogLevel and LogFormat keys of v.
+func Configure(v *viper.Viper) {
+	if v.IsSet("LogLevel") {
+		Level = v.GetString("LogLevel")
+	}
+	if v.IsSet("LogFormat") {
+		Format = v.GetString("LogFormat")
+	}
+}
+
+// Setup makes a logger writing to standard output the default logger.
+func Setup(service string) error {
+	l, err := New(os.Stdout, service)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(l)
+	return nil
+}
+
+// New returns a logger writing to w at Level in Format. Every record carries
+// the name of the service.
+func New(w io.Writer, service string) (*slog.Logger, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(Level))
+	if err != nil {
+		return nil, fmt.Errorf("invalid log level %q", Level)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	switch strings.ToLower(Format) {
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("invalid log format %q", Format)
+	}
+	return slog.New(h).With("service", service), nil
+}
+
+// Fatal logs msg at error level and exits.
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,76 @@
+// Package metrics defines the Prometheus metrics of the simulation that the
+// controller and the workers share, and serves them on /metrics.
+package metrics
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Phases of a step. The controller moves the nodes, dispatches the
+// partitions and waits at the barrier; a worker queries the neighbors of its
+// partition and computes their links.
+const (
+	PhaseMobility      = "mobility"
+	PhaseDispatch      = "dispatch"
+	PhaseNeighborQuery = "neighbor_query"
+	PhaseChannel       = "channel"
+	PhaseBarrierWait   = "barrier_wait"
+)
+
+var (
+	PhaseDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sim_step_phase_duration_seconds",
+		Help:    "Time spent in each phase of a step. Worker phases are observed once per partition.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 18),
+	}, []string{"phase"})
+	Neighbors = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "sim_node_neighbors",
+		Help:    "Number of neighbors of a node in a step.",
+		Buckets: []float64{0, 1, 2, 4, 8, 16, 32, 64, 128, 256, 512},
+	})
+	WorkerLinks = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sim_worker_links",
+		Help: "Links computed by each worker in the last finished step.",
+	}, []string{"worker"})
+	QueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sim_queue_depth",
+		Help: "Tasks waiting in or being processed from each worker queue.",
+	}, []string{"queue"})
+)
+
+// ObservePhase records that phase ran from start until now and returns how
+// long that was.
+func ObservePhase(phase string, start time.Time) time.Duration {
+	d := time.Since(start)
+	PhaseDuration.WithLabelValues(phase).Observe(d.Seconds())
+	return d
+}
+
+// SetWorkerLinks records the links a worker computed in the last step.
+func SetWorkerLinks(worker int, links int) {
+	WorkerLinks.WithLabelValues(strconv.Itoa(worker)).Set(float64(links))
+}
+
+// Serve exposes the metrics on port in the background. A port of 0 disables
+// the endpoint.
+func Serve(port int) {
+	if port == 0 {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		err := http.ListenAndServe(fmt.Sprintf(":%d", port), mux)
+		if err != nil {
+			slog.Error("metrics endpoint failed", "port", port, "err", err)
+		}
+	}()
+}
@@ -0,0 +1,226 @@
+package tasks
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+// A list of task types.
+const (
+	TypeKDtreeDelivery = "kdtree:deliver"
+)
+
+// NotificationChannel is the Redis pub/sub channel workers report on.
+const NotificationChannel = "task_notification"
+
+// QueueName is the asynq queue served by the given worker.
+func QueueName(workerID int) string {
+	return fmt.Sprintf("queue%d", workerID)
+}
+
+// PayloadVersion identifies the layout of KDtreeDeliveryPayload. Workers
+// refuse payloads of any other version.
+const PayloadVersion = 6
+
+type Vector struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	Z float64 `json:"z"`
+}
+
+type RadioParams struct {
+	Frequency  float64 `json:"frequency"`
+	BitRate    float64 `json:"bitrate"`
+	Modulation string  `json:"modulation"`
+	BandWidth  float64 `json:"bandwidth"`
+	M          float64 `json:"m"`
+	PowerInDbm float64 `json:"powerindbm"`
+}
+
+// NodeDescriptor is the complete state of one node as simulated by the
+// controller, so that workers need no node state of their own.
+type NodeDescriptor struct {
+	ID              int64       `json:"id"`
+	Position        Vector      `json:"position"`
+	Velocity        Vector      `json:"velocity"`
+	Radio           RadioParams `json:"radio"`
+	Range           float64     `json:"range"`
+	MobilityModel   string      `json:"mobilitymodel"`
+	LargeScaleModel string      `json:"largescalemodel"`
+	SmallScaleModel string      `json:"smallscalemodel"`
+}
+
+// KDtreeDeliveryPayload carries the whole node set of one step together
+// with one partition: the IDs of the source nodes whose links the receiving
+// worker computes. Nodes are ordered by ID and IDs run from 0 to
+// len(Nodes)-1. Partitions are numbered from 1 and normally computed by the
+// worker of the same ID, but may be handed to another worker.
+type KDtreeDeliveryPayload struct {
+	Version   int
+	RunID     string
+	Seed      int64
+	Step      int
+	Partition int
+	Nodes     []NodeDescriptor
+	Sources   []int64
+	// TraceContext carries the span of the enqueue to the worker.
+	TraceContext map[string]string `json:",omitempty"`
+}
+
+//----------------------------------------------
+// Write a function NewXXXTask to create a task.
+// A task consists of a type and a payload.
+//----------------------------------------------
+
+func NewKDtreeDeliveryTask(p KDtreeDeliveryPayload) (*asynq.Task, error) {
+	p.Version = PayloadVersion
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return asynq.NewTask(TypeKDtreeDelivery, payload), nil
+}
+
+// TaskID is the asynq task ID of a partition of a step. asynq refuses a task
+// whose ID is still in use on the queue, so a partition is queued at most
+// once per worker.
+func TaskID(runID string, step int, partition int, sourcesHash string) string {
+	return fmt.Sprintf("%s:%s:%d:%d:%s", TypeKDtreeDelivery, runID, step, partition, sourcesHash)
+}
+
+// SourcesHash fingerprints the source nodes of a partition. Task IDs and
+// result keys include it, so partitions that share a number but not their
+// sources, as after a run is resumed with other workers, never share a task
+// or a result.
+func SourcesHash(sources []int64) string {
+	h := sha256.New()
+	for _, id := range sources {
+		binary.Write(h, binary.LittleEndian, id)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// LinkResult is the channel model output for one directed link.
+type LinkResult struct {
+	LinkId   int64   `json:"linkid"`
+	TxID     int64   `json:"txid"`
+	RxID     int64   `json:"rxid"`
+	PathLoss float64 `json:"pathloss"`
+	RxPower  float64 `json:"rxpower"`
+	SNR      float64 `json:"snr"`
+	PLR      float64 `json:"plr"`
+}
+
+// NeighborSet lists the nodes within communication range of one node.
+type NeighborSet struct {
+	ID        int64   `json:"id"`
+	Neighbors []int64 `json:"neighbors"`
+}
+
+// PartitionResult holds the links and neighbor sets of one partition of a
+// step.
+type PartitionResult struct {
+	Step        int
+	Partition   int
+	SourcesHash string
+	WorkerID    int
+	Links       []LinkResult
+	Neighbors   []NeighborSet
+	// NeighborQuery and Channel are the time the worker spent querying the
+	// neighbors and computing the links; ChannelCalls counts its requests
+	// to the channel service.
+	NeighborQuery time.Duration
+	Channel       time.Duration
+	ChannelCalls  ServiceCalls
+}
+
+// ServiceCalls counts the requests made to a model service and how many of
+// them failed.
+type ServiceCalls struct {
+	Calls  int `json:"calls"`
+	Errors int `json:"errors"`
+}
+
+func (c *ServiceCalls) Add(o ServiceCalls) {
+	c.Calls += o.Calls
+	c.Errors += o.Errors
+}
+
+// ErrorRate is the fraction of failed requests.
+func (c ServiceCalls) ErrorRate() float64 {
+	if c.Calls == 0 {
+		return 0
+	}
+	return float64(c.Errors) / float64(c.Calls)
+}
+
+// ResultTTL bounds how long partition results stay in Redis after a step.
+const ResultTTL = 24 * time.Hour
+
+// ResultKey is the Redis key a worker stores a partition result under. Only
+// the first result stored for a partition is kept.
+func ResultKey(runID string, step int, partition int, sourcesHash string) string {
+	return fmt.Sprintf("results:%s:%d:%d:%s", runID, step, partition, sourcesHash)
+}
+
+// TaskNotification is published on NotificationChannel by a worker once a
+// partition of a step is computed and its result is stored, or once the task
+// computing it fails.
+type TaskNotification struct {
+	RunID       string `json:"runid"`
+	Step        int    `json:"step"`
+	Partition   int    `json:"partition"`
+	SourcesHash string `json:"sourceshash"`
+	WorkerID    int    `json:"workerid"`
+	SourceCount int    `json:"sourcecount"`
+	LinkCount   int    `json:"linkcount"`
+	// Failed marks a task that gave up; it does not complete the partition
+	// and only reports the channel requests the task made.
+	Failed       bool         `json:"failed"`
+	ChannelCalls ServiceCalls `json:"channelcalls"`
+}
+
+// HeartbeatChannel is the Redis pub/sub channel workers send heartbeats on.
+const HeartbeatChannel = "worker_heartbeat"
+
+// Heartbeat is published periodically by every worker. Tasks lists the tasks
+// in progress; an idle worker sends none.
+type Heartbeat struct {
+	WorkerID int            `json:"workerid"`
+	Tasks    []TaskProgress `json:"tasks"`
+}
+
+// TaskProgress names a partition in progress of which Done of Total links
+// are computed.
+type TaskProgress struct {
+	RunID     string `json:"runid"`
+	Step      int    `json:"step"`
+	Partition int    `json:"partition"`
+	Done      int    `json:"done"`
+	Total     int    `json:"total"`
+}
+
+// DeriveSeed mixes the run seed with identifiers such as step, node or link
+// ID into an independent seed, so that every random draw in a run is fixed by
+// the run seed alone no matter which process makes it or in which order.
+func DeriveSeed(seed int64, ids ...int64) int64 {
+	x := uint64(seed)
+	for _, id := range ids {
+		x ^= uint64(id) + 0x9e3779b97f4a7c15 + (x << 6) + (x >> 2)
+		x = splitmix64(x)
+	}
+	return int64(splitmix64(x))
+}
+
+func splitmix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
@@ -0,0 +1,117 @@
+// Package tracing sets up OpenTelemetry tracing for the controller and the
+// workers and carries trace context across the task queue.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// Exporter selects where spans go: "none" drops them, "file" appends
+	// them to File as one JSON object per line and "otlp" sends them to the
+	// OTLP/HTTP collector at Endpoint.
+	Exporter = "none"
+	File     = "../output/traces.jsonl"
+	Endpoint = "localhost:4318"
+)
+
+// Configure reads Exporter, File and Endpoint from the TraceExporter,
+// TraceFile and TraceEndpoint keys of v.
+func Configure(v *viper.Viper) {
+	if v.IsSet("TraceExporter") {
+		Exporter = v.GetString("TraceExporter")
+	}
+	if v.IsSet("TraceFile") {
+		File = v.GetString("TraceFile")
+	}
+	if v.IsSet("TraceEndpoint") {
+		Endpoint = v.GetString("TraceEndpoint")
+	}
+}
+
+// Tracer creates the spans of the simulation.
+var Tracer = otel.Tracer("github.com/LeBronQ/tasks/tracing")
+
+// Setup installs the tracer provider of the process, naming it service. The
+// returned function flushes the spans still buffered and must be called
+// before the process exits.
+func Setup(ctx context.Context, service string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch Exporter {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "file":
+		exporter, err = fileExporter(File)
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx, otlptracehttp.WithEndpoint(Endpoint), otlptracehttp.WithInsecure())
+	default:
+		err = fmt.Errorf("unknown trace exporter %q", Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := resource.NewSchemaless(semconv.ServiceName(service))
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// fileExporter appends spans to path. Several processes may share the file;
+// every span is written with a single append.
+func fileExporter(path string) (sdktrace.SpanExporter, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return stdouttrace.New(stdouttrace.WithWriter(f))
+}
+
+// Inject returns the trace context of ctx in a form that can travel inside
+// a task payload.
+func Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// Extract returns ctx carrying the trace context taken from a task payload.
+func Extract(ctx context.Context, tc map[string]string) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(tc))
+}
+
+// Start starts a span of the simulation.
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return Tracer.Start(ctx, name, opts...)
+}
+
+// End ends span, recording err if it is not nil.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,204 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/LeBronQ/tasks"
+)
+
+// MemoryRetries is the number of times the in-process transport retries a
+// failed task.
+var MemoryRetries = 3
+
+type memoryTask struct {
+	id      string
+	payload []byte
+}
+
+type memoryResult struct {
+	runID string
+	step  int
+	data  []byte
+}
+
+// Memory connects a controller and workers running in one process. It is
+// both ends of the transport; payloads and results are passed as JSON, as
+// between processes, so that no state is shared by accident.
+type Memory struct {
+	mu      sync.Mutex
+	queues  map[string]chan memoryTask
+	queued  map[string]map[string]bool
+	results map[string]memoryResult
+	notes   chan tasks.TaskNotification
+	beats   chan tasks.Heartbeat
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		queues:  map[string]chan memoryTask{},
+		queued:  map[string]map[string]bool{},
+		results: map[string]memoryResult{},
+		notes:   make(chan tasks.TaskNotification, 1024),
+		beats:   make(chan tasks.Heartbeat, 1024),
+	}
+}
+
+func (m *Memory) queue(name string) chan memoryTask {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q, ok := m.queues[name]
+	if !ok {
+		q = make(chan memoryTask, 4096)
+		m.queues[name] = q
+		m.queued[name] = map[string]bool{}
+	}
+	return q
+}
+
+func (m *Memory) Dispatch(ctx context.Context, queue string, payload tasks.KDtreeDeliveryPayload) error {
+	task, err := tasks.NewKDtreeDeliveryTask(payload)
+	if err != nil {
+		return fmt.Errorf("could not create task: %v", err)
+	}
+	q := m.queue(queue)
+	id := tasks.TaskID(payload.RunID, payload.Step, payload.Partition, tasks.SourcesHash(payload.Sources))
+	m.mu.Lock()
+	if m.queued[queue][id] {
+		m.mu.Unlock()
+		return ErrDuplicateTask
+	}
+	m.queued[queue][id] = true
+	m.mu.Unlock()
+	select {
+	case q <- memoryTask{id: id, payload: task.Payload()}:
+		return nil
+	case <-ctx.Done():
+		m.mu.Lock()
+		delete(m.queued[queue], id)
+		m.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (m *Memory) QueueDepth(ctx context.Context, queue string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.queued[queue]), nil
+}
+
+func (m *Memory) Notifications() <-chan tasks.TaskNotification {
+	return m.notes
+}
+
+func (m *Memory) Heartbeats() <-chan tasks.Heartbeat {
+	return m.beats
+}
+
+func (m *Memory) Serve(ctx context.Context, queue string, concurrency int, handler Handler) error {
+	q := m.queue(queue)
+	var wg sync.WaitGroup
+	for i := 0; i < max(1, concurrency); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case t := <-q:
+					m.run(ctx, t, handler)
+					m.mu.Lock()
+					delete(m.queued[queue], t.id)
+					m.mu.Unlock()
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+func (m *Memory) run(ctx context.Context, t memoryTask, handler Handler) {
+	for attempt := 0; attempt <= MemoryRetries; attempt++ {
+		var payload tasks.KDtreeDeliveryPayload
+		err := json.Unmarshal(t.payload, &payload)
+		if err == nil {
+			err = handler(ctx, &payload)
+		} else {
+			err = fmt.Errorf("json.Unmarshal failed: %v: %w", err, ErrPermanent)
+		}
+		if err == nil {
+			return
+		}
+		slog.Warn("task failed", "task", t.id, "attempt", attempt+1, "err", err)
+		if errors.Is(err, ErrPermanent) || ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+func (m *Memory) StoreResult(ctx context.Context, runID string, result tasks.PartitionResult) (tasks.PartitionResult, error) {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return result, err
+	}
+	key := tasks.ResultKey(runID, result.Step, result.Partition, result.SourcesHash)
+	m.mu.Lock()
+	if _, ok := m.results[key]; !ok {
+		m.results[key] = memoryResult{runID: runID, step: result.Step, data: data}
+	}
+	m.mu.Unlock()
+	return m.FetchResult(ctx, runID, result.Step, result.Partition, result.SourcesHash)
+}
+
+func (m *Memory) FetchResult(ctx context.Context, runID string, step int, partition int, sourcesHash string) (tasks.PartitionResult, error) {
+	var result tasks.PartitionResult
+	m.mu.Lock()
+	stored, ok := m.results[tasks.ResultKey(runID, step, partition, sourcesHash)]
+	m.mu.Unlock()
+	if !ok {
+		return result, ErrNoResult
+	}
+	err := json.Unmarshal(stored.data, &result)
+	return result, err
+}
+
+// ReleaseResults drops the stored results of the step and all earlier steps
+// of the run, including those stored late by redelivered tasks.
+func (m *Memory) ReleaseResults(ctx context.Context, runID string, step int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, r := range m.results {
+		if r.runID == runID && r.step <= step {
+			delete(m.results, key)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Notify(ctx context.Context, n tasks.TaskNotification) error {
+	select {
+	case m.notes <- n:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *Memory) Heartbeat(ctx context.Context, hb tasks.Heartbeat) error {
+	select {
+	case m.beats <- hb:
+	default:
+		// Heartbeats are only useful while fresh.
+	}
+	return nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
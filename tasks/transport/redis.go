@@ -0,0 +1,224 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/LeBronQ/tasks"
+	"github.com/go-redis/redis/v8"
+	"github.com/hibiken/asynq"
+)
+
+// RedisController dispatches tasks through asynq and receives notifications
+// and heartbeats over Redis pub/sub.
+type RedisController struct {
+	client    *asynq.Client
+	inspector *asynq.Inspector
+	rdb       *redis.Client
+	pubsub    *redis.PubSub
+	notes     chan tasks.TaskNotification
+	beats     chan tasks.Heartbeat
+}
+
+func NewRedisController(addr string) (*RedisController, error) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: addr,
+	})
+	pubsub := rdb.Subscribe(context.Background(), tasks.NotificationChannel, tasks.HeartbeatChannel)
+	// Wait for the subscription so that no notification is missed.
+	_, err := pubsub.Receive(context.Background())
+	if err != nil {
+		pubsub.Close()
+		rdb.Close()
+		return nil, err
+	}
+	c := &RedisController{
+		client:    asynq.NewClient(asynq.RedisClientOpt{Addr: addr}),
+		inspector: asynq.NewInspector(asynq.RedisClientOpt{Addr: addr}),
+		rdb:       rdb,
+		pubsub:    pubsub,
+		notes:     make(chan tasks.TaskNotification, 1024),
+		beats:     make(chan tasks.Heartbeat, 1024),
+	}
+	go c.listen(pubsub.Channel())
+	return c, nil
+}
+
+func (c *RedisController) listen(msgs <-chan *redis.Message) {
+	defer close(c.notes)
+	defer close(c.beats)
+	for m := range msgs {
+		switch m.Channel {
+		case tasks.HeartbeatChannel:
+			var hb tasks.Heartbeat
+			err := json.Unmarshal([]byte(m.Payload), &hb)
+			if err != nil {
+				slog.Warn("ignoring malformed heartbeat", "payload", m.Payload, "err", err)
+				continue
+			}
+			select {
+			case c.beats <- hb:
+			default:
+				// Heartbeats are only useful while fresh.
+			}
+		case tasks.NotificationChannel:
+			var n tasks.TaskNotification
+			err := json.Unmarshal([]byte(m.Payload), &n)
+			if err != nil {
+				slog.Warn("ignoring malformed notification", "payload", m.Payload, "err", err)
+				continue
+			}
+			c.notes <- n
+		}
+	}
+}
+
+func (c *RedisController) Dispatch(ctx context.Context, queue string, payload tasks.KDtreeDeliveryPayload) error {
+	task, err := tasks.NewKDtreeDeliveryTask(payload)
+	if err != nil {
+		return fmt.Errorf("could not create task: %v", err)
+	}
+	id := tasks.TaskID(payload.RunID, payload.Step, payload.Partition, tasks.SourcesHash(payload.Sources))
+	_, err = c.client.EnqueueContext(ctx, task, asynq.Queue(queue), asynq.TaskID(id))
+	if errors.Is(err, asynq.ErrTaskIDConflict) {
+		return ErrDuplicateTask
+	}
+	if err != nil {
+		return fmt.Errorf("could not enqueue task: %v", err)
+	}
+	return nil
+}
+
+func (c *RedisController) Notifications() <-chan tasks.TaskNotification {
+	return c.notes
+}
+
+func (c *RedisController) Heartbeats() <-chan tasks.Heartbeat {
+	return c.beats
+}
+
+func (c *RedisController) FetchResult(ctx context.Context, runID string, step int, partition int, sourcesHash string) (tasks.PartitionResult, error) {
+	return fetchResult(ctx, c.rdb, runID, step, partition, sourcesHash)
+}
+
+func (c *RedisController) QueueDepth(ctx context.Context, queue string) (int, error) {
+	info, err := c.inspector.GetQueueInfo(queue)
+	if errors.Is(err, asynq.ErrQueueNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Pending + info.Active + info.Scheduled + info.Retry, nil
+}
+
+// ReleaseResults leaves the results in Redis, where they expire after
+// tasks.ResultTTL.
+func (c *RedisController) ReleaseResults(ctx context.Context, runID string, step int) error {
+	return nil
+}
+
+func (c *RedisController) Close() error {
+	c.pubsub.Close()
+	c.inspector.Close()
+	c.client.Close()
+	return c.rdb.Close()
+}
+
+func fetchResult(ctx context.Context, rdb *redis.Client, runID string, step int, partition int, sourcesHash string) (tasks.PartitionResult, error) {
+	var result tasks.PartitionResult
+	data, err := rdb.Get(ctx, tasks.ResultKey(runID, step, partition, sourcesHash)).Bytes()
+	if err == redis.Nil {
+		return result, ErrNoResult
+	}
+	if err != nil {
+		return result, err
+	}
+	err = json.Unmarshal(data, &result)
+	return result, err
+}
+
+// RedisWorker serves an asynq queue and reports results through Redis.
+type RedisWorker struct {
+	addr string
+	rdb  *redis.Client
+}
+
+func NewRedisWorker(addr string) *RedisWorker {
+	return &RedisWorker{
+		addr: addr,
+		rdb: redis.NewClient(&redis.Options{
+			Addr: addr,
+		}),
+	}
+}
+
+func (w *RedisWorker) Serve(ctx context.Context, queue string, concurrency int, handler Handler) error {
+	srv := asynq.NewServer(
+		asynq.RedisClientOpt{Addr: w.addr},
+		asynq.Config{
+			Concurrency: concurrency,
+			Queues: map[string]int{
+				queue: 6,
+			},
+		},
+	)
+	mux := asynq.NewServeMux()
+	mux.HandleFunc(tasks.TypeKDtreeDelivery, func(ctx context.Context, t *asynq.Task) error {
+		var payload tasks.KDtreeDeliveryPayload
+		if err := json.Unmarshal(t.Payload(), &payload); err != nil {
+			return fmt.Errorf("json.Unmarshal failed: %v: %w", err, asynq.SkipRetry)
+		}
+		err := handler(ctx, &payload)
+		if errors.Is(err, ErrPermanent) {
+			return fmt.Errorf("%v: %w", err, asynq.SkipRetry)
+		}
+		return err
+	})
+	err := srv.Start(mux)
+	if err != nil {
+		return err
+	}
+	<-ctx.Done()
+	srv.Shutdown()
+	return nil
+}
+
+func (w *RedisWorker) StoreResult(ctx context.Context, runID string, result tasks.PartitionResult) (tasks.PartitionResult, error) {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return result, err
+	}
+	stored, err := w.rdb.SetNX(ctx, tasks.ResultKey(runID, result.Step, result.Partition, result.SourcesHash), data, tasks.ResultTTL).Result()
+	if err != nil || stored {
+		return result, err
+	}
+	return fetchResult(ctx, w.rdb, runID, result.Step, result.Partition, result.SourcesHash)
+}
+
+func (w *RedisWorker) FetchResult(ctx context.Context, runID string, step int, partition int, sourcesHash string) (tasks.PartitionResult, error) {
+	return fetchResult(ctx, w.rdb, runID, step, partition, sourcesHash)
+}
+
+func (w *RedisWorker) Notify(ctx context.Context, n tasks.TaskNotification) error {
+	return w.publish(ctx, tasks.NotificationChannel, n)
+}
+
+func (w *RedisWorker) Heartbeat(ctx context.Context, hb tasks.Heartbeat) error {
+	return w.publish(ctx, tasks.HeartbeatChannel, hb)
+}
+
+func (w *RedisWorker) publish(ctx context.Context, channel string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return w.rdb.Publish(ctx, channel, data).Err()
+}
+
+func (w *RedisWorker) Close() error {
+	return w.rdb.Close()
+}
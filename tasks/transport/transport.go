@@ -0,0 +1,65 @@
+// Package transport carries partition tasks from the controller to the
+// workers and their results back. Redis connects separate processes through
+// asynq queues, Redis keys and pub/sub; Memory connects a controller and
+// workers running in one process.
+package transport
+
+import (
+	"context"
+	"errors"
+
+	"github.com/LeBronQ/tasks"
+)
+
+var (
+	// ErrDuplicateTask is returned by Dispatch for a partition that is
+	// still queued for the same worker.
+	ErrDuplicateTask = errors.New("task already queued")
+	// ErrNoResult is returned by FetchResult for a partition without a
+	// stored result.
+	ErrNoResult = errors.New("no result stored")
+	// ErrPermanent marks handler errors that a retry cannot fix.
+	ErrPermanent = errors.New("permanent failure")
+)
+
+// Handler computes one partition task.
+type Handler func(ctx context.Context, payload *tasks.KDtreeDeliveryPayload) error
+
+// Controller is the controller's end of a transport.
+type Controller interface {
+	// Dispatch queues a partition task on the queue of a worker.
+	Dispatch(ctx context.Context, queue string, payload tasks.KDtreeDeliveryPayload) error
+	// Notifications delivers the completion notifications of all workers.
+	Notifications() <-chan tasks.TaskNotification
+	// Heartbeats delivers the heartbeats of all workers.
+	Heartbeats() <-chan tasks.Heartbeat
+	// FetchResult returns the stored result of a partition with the
+	// given sources.
+	FetchResult(ctx context.Context, runID string, step int, partition int, sourcesHash string) (tasks.PartitionResult, error)
+	// QueueDepth returns the number of tasks waiting in or being processed
+	// from a queue.
+	QueueDepth(ctx context.Context, queue string) (int, error)
+	// ReleaseResults tells the transport that the controller has merged
+	// the results of a step and no longer needs them.
+	ReleaseResults(ctx context.Context, runID string, step int) error
+	Close() error
+}
+
+// Worker is a worker's end of a transport.
+type Worker interface {
+	// Serve runs handler on the tasks of queue, concurrency at a time,
+	// until ctx is done. Failed tasks are retried unless the error wraps
+	// ErrPermanent.
+	Serve(ctx context.Context, queue string, concurrency int, handler Handler) error
+	// StoreResult stores the result of a partition unless one is stored
+	// already, and returns the stored result.
+	StoreResult(ctx context.Context, runID string, result tasks.PartitionResult) (tasks.PartitionResult, error)
+	// FetchResult returns the stored result of a partition with the
+	// given sources.
+	FetchResult(ctx context.Context, runID string, step int, partition int, sourcesHash string) (tasks.PartitionResult, error)
+	// Notify reports a finished partition to the controller.
+	Notify(ctx context.Context, n tasks.TaskNotification) error
+	// Heartbeat sends a heartbeat to the controller.
+	Heartbeat(ctx context.Context, hb tasks.Heartbeat) error
+	Close() error
+}
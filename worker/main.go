@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/LeBronQ/discovery"
+	"github.com/LeBronQ/tasks"
+	"github.com/LeBronQ/tasks/logging"
+	"github.com/LeBronQ/tasks/metrics"
+	"github.com/LeBronQ/tasks/tracing"
+	"github.com/LeBronQ/tasks/transport"
+	"github.com/LeBronQ/worker/simworker"
+	"github.com/spf13/viper"
+)
+
+const (
+	consul_address = "127.0.0.1:8500"
+	redisAddr      = "127.0.0.1:6379"
+)
+
+var (
+	WorkerID int
+	// Capacity is the number of tasks the worker runs at a time.
+	Capacity int
+	// MetricsPort is the port of the controller's metrics endpoint; worker
+	// i serves its metrics on MetricsPort+i. 0 disables the endpoint.
+	MetricsPort = 9100
+)
+
+// envInt reads an integer from the environment, falling back to def.
+func envInt(name string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+func main() {
+	flag.IntVar(&WorkerID, "id", envInt("WORKER_ID", 0), "worker index starting at 1 (env WORKER_ID)")
+	flag.IntVar(&Capacity, "capacity", envInt("WORKER_CAPACITY", 0), "tasks run at a time (env WORKER_CAPACITY), overrides WorkerCapacity in the config")
+	configFile := flag.String("config", "../config.yaml", "path to the simulation config")
+	flag.Parse()
+
+	viper.SetConfigFile(*configFile)
+	err := viper.ReadInConfig()
+	if err != nil {
+		logging.Fatal("could not read config", "path", *configFile, "err", err)
+	}
+	logging.Configure(viper.GetViper())
+	err = logging.Setup(discovery.WorkerService)
+	if err != nil {
+		logging.Fatal("could not set up logging", "err", err)
+	}
+	slog.SetDefault(slog.With("worker", WorkerID))
+	if viper.IsSet("ChannelBatchSize") {
+		simworker.ChannelBatchSize = viper.GetInt("ChannelBatchSize")
+	}
+	if viper.IsSet("ChannelMaxInFlight") {
+		simworker.ChannelMaxInFlight = max(1, viper.GetInt("ChannelMaxInFlight"))
+	}
+	if WorkerID < 1 {
+		logging.Fatal("worker id must be at least 1", "id", WorkerID)
+	}
+	if Capacity == 0 {
+		Capacity = 1
+		if viper.IsSet("WorkerCapacity") {
+			Capacity = viper.GetInt("WorkerCapacity")
+		}
+	}
+	if Capacity < 1 {
+		logging.Fatal("worker capacity must be at least 1", "capacity", Capacity)
+	}
+	if viper.IsSet("HeartbeatInterval") {
+		simworker.HeartbeatInterval = viper.GetDuration("HeartbeatInterval")
+	}
+	checkTTL := 5 * simworker.HeartbeatInterval
+	if viper.IsSet("HeartbeatTimeout") {
+		checkTTL = viper.GetDuration("HeartbeatTimeout")
+	}
+	discovery.Configure(viper.GetViper())
+	if viper.IsSet("MetricsPort") {
+		MetricsPort = viper.GetInt("MetricsPort")
+	}
+	tracing.Configure(viper.GetViper())
+	slog.Info("worker started", "queue", tasks.QueueName(WorkerID), "capacity", Capacity)
+	if MetricsPort != 0 {
+		metrics.Serve(MetricsPort + WorkerID)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	shutdown, err := tracing.Setup(ctx, discovery.WorkerService)
+	if err != nil {
+		logging.Fatal("could not set up tracing", "err", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdown(ctx); err != nil {
+			slog.Warn("could not flush traces", "err", err)
+		}
+	}()
+
+	channelPool := discovery.NewPool("Default_ChannelModel", discovery.NewHTTPClient())
+	err = discovery.Follow(ctx, consul_address, channelPool)
+	if err != nil {
+		slog.Warn("could not discover the channel service, still watching", "err", err)
+	}
+
+	t := transport.NewRedisWorker(redisAddr)
+	defer t.Close()
+	w := simworker.New(WorkerID, t, channelPool)
+	go w.SendHeartbeats(ctx, simworker.HeartbeatInterval)
+
+	reg, err := discovery.RegisterWorker(consul_address, discovery.Worker{
+		ID:       WorkerID,
+		Queue:    tasks.QueueName(WorkerID),
+		Capacity: Capacity,
+	}, checkTTL)
+	if err != nil {
+		logging.Fatal("could not register with consul", "err", err)
+	}
+	go reg.KeepAlive(ctx, simworker.HeartbeatInterval)
+
+	err = w.Serve(ctx, tasks.QueueName(WorkerID), Capacity)
+	if derr := reg.Deregister(); derr != nil {
+		slog.Warn("could not deregister from consul", "err", derr)
+	}
+	if err != nil {
+		logging.Fatal("could not run server", "err", err)
+	}
+}
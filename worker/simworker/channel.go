@@ -0,0 +1,178 @@
+package simworker
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/LeBronQ/discovery"
+	"github.com/LeBronQ/tasks"
+	"github.com/LeBronQ/tasks/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// ChannelBatchSize is the number of links per channel request. With 0
+	// or less every source node sends all of its links in one request.
+	ChannelBatchSize   = 0
+	ChannelMaxInFlight = 8
+)
+
+// channelBatch falls back to per-link requests once the service has
+// answered a batch request as unknown.
+var channelBatch = discovery.BatchFallback{Service: "channel"}
+
+// LinkRequest is one directed link waiting for its channel parameters.
+type LinkRequest struct {
+	TxID   int64
+	RxID   int64
+	Params ChannelReqParams
+}
+
+type ChannelBatchReqParams struct {
+	Links []ChannelReqParams `json:"links"`
+}
+
+type ChannelBatchResult struct {
+	Results []tasks.LinkResult `json:"results"`
+}
+
+// ChannelRequest computes the channel parameters of a single link.
+func ChannelRequest(ctx context.Context, param ChannelReqParams, pool *discovery.Pool) (result tasks.LinkResult, err error) {
+	ctx, span := tracing.Start(ctx, "ChannelRequest", trace.WithAttributes(attribute.Int64("link", param.LinkId)))
+	defer func() { tracing.End(span, err) }()
+	err = pool.Post(ctx, "/model", param, &result)
+	return result, err
+}
+
+// ChannelBatchRequest computes the channel parameters of many links in one
+// request. Results are matched to the requested links by link ID, so the
+// service may answer in any order.
+func ChannelBatchRequest(ctx context.Context, params []ChannelReqParams, pool *discovery.Pool) (_ map[int64]tasks.LinkResult, err error) {
+	ctx, span := tracing.Start(ctx, "ChannelBatchRequest", trace.WithAttributes(attribute.Int("links", len(params))))
+	defer func() { tracing.End(span, err) }()
+	var res ChannelBatchResult
+	err = pool.Post(ctx, "/model/batch", ChannelBatchReqParams{Links: params}, &res)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[int64]tasks.LinkResult, len(res.Results))
+	for _, r := range res.Results {
+		byID[r.LinkId] = r
+	}
+	for _, p := range params {
+		if _, ok := byID[p.LinkId]; !ok {
+			return nil, fmt.Errorf("batch of %d links is missing link %d", len(params), p.LinkId)
+		}
+	}
+	return byID, nil
+}
+
+// calculateBatch computes one batch of links, using the batch endpoint while
+// the service supports it. It stops at the first link that fails.
+func (w *Worker) calculateBatch(ctx context.Context, batch []LinkRequest, step int) ([]tasks.LinkResult, error) {
+	links := make([]tasks.LinkResult, 0, len(batch))
+	err := channelBatch.Do(func() error {
+		params := make([]ChannelReqParams, len(batch))
+		for i, l := range batch {
+			params[i] = l.Params
+		}
+		byID, err := ChannelBatchRequest(ctx, params, w.Channel)
+		if discovery.BatchUnsupported(err) {
+			return err
+		}
+		if err != nil {
+			w.Log.Warn("channel batch failed", "step", step, "links", len(batch), "err", err)
+			return fmt.Errorf("channel batch of %d links: %w", len(batch), err)
+		}
+		for _, l := range batch {
+			r := byID[l.Params.LinkId]
+			r.TxID = l.TxID
+			r.RxID = l.RxID
+			links = append(links, r)
+		}
+		return nil
+	}, func() error {
+		for _, l := range batch {
+			r, err := ChannelRequest(ctx, l.Params, w.Channel)
+			if err != nil {
+				w.Log.Warn("channel request failed", "step", step, "node", l.TxID, "rx", l.RxID, "err", err)
+				return fmt.Errorf("channel of link %d->%d: %w", l.TxID, l.RxID, err)
+			}
+			r.LinkId = l.Params.LinkId
+			r.TxID = l.TxID
+			r.RxID = l.RxID
+			links = append(links, r)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+// CalculateLinks computes all links of a partition, counting them on tracker.
+// groups holds the links of each source node; they are regrouped into batches
+// of ChannelBatchSize when that is set. At most ChannelMaxInFlight batches
+// are in flight at a time. The result is ordered by link ID and comes with
+// the requests made to the channel service, which are counted even when
+// CalculateLinks fails because a link could not be computed.
+func (w *Worker) CalculateLinks(ctx context.Context, tracker *Tracker, groups [][]LinkRequest, step int) ([]tasks.LinkResult, tasks.ServiceCalls, error) {
+	batches := groups
+	if ChannelBatchSize > 0 {
+		batches = [][]LinkRequest{}
+		batch := []LinkRequest{}
+		for _, g := range groups {
+			for _, l := range g {
+				batch = append(batch, l)
+				if len(batch) == ChannelBatchSize {
+					batches = append(batches, batch)
+					batch = []LinkRequest{}
+				}
+			}
+		}
+		if len(batch) > 0 {
+			batches = append(batches, batch)
+		}
+	}
+
+	counter := &discovery.CallCounter{}
+	ctx = discovery.WithCallCounter(ctx, counter)
+	results := make([][]tasks.LinkResult, len(batches))
+	errs := make([]error, len(batches))
+	sem := make(chan struct{}, ChannelMaxInFlight)
+	var wg sync.WaitGroup
+	for i, b := range batches {
+		if len(b) == 0 {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, b []LinkRequest) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i], errs[i] = w.calculateBatch(ctx, b, step)
+			tracker.Add(len(b))
+		}(i, b)
+	}
+	wg.Wait()
+
+	attempts, errors := counter.Counts()
+	total := tasks.ServiceCalls{Calls: attempts, Errors: errors}
+	links := []tasks.LinkResult{}
+	var failed []error
+	for i, r := range results {
+		links = append(links, r...)
+		if errs[i] != nil {
+			failed = append(failed, errs[i])
+		}
+	}
+	if len(failed) > 0 {
+		return nil, total, fmt.Errorf("%d of %d channel batches failed, first: %w", len(failed), len(batches), failed[0])
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].LinkId < links[j].LinkId })
+	return links, total, nil
+}
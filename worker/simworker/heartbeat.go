@@ -0,0 +1,96 @@
+package simworker
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/LeBronQ/tasks"
+)
+
+var HeartbeatInterval = 2 * time.Second
+
+// Progress tracks the tasks a worker is computing, for heartbeats.
+type Progress struct {
+	mu    sync.Mutex
+	tasks map[*Tracker]bool
+}
+
+// Tracker follows one task in progress.
+type Tracker struct {
+	p  *Progress
+	tp tasks.TaskProgress
+}
+
+// Start marks the beginning of a partition with total links to compute.
+func (p *Progress) Start(payload *tasks.KDtreeDeliveryPayload, total int) *Tracker {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t := &Tracker{p: p, tp: tasks.TaskProgress{
+		RunID:     payload.RunID,
+		Step:      payload.Step,
+		Partition: payload.Partition,
+		Total:     total,
+	}}
+	if p.tasks == nil {
+		p.tasks = map[*Tracker]bool{}
+	}
+	p.tasks[t] = true
+	return t
+}
+
+// Add records n more computed links.
+func (t *Tracker) Add(n int) {
+	t.p.mu.Lock()
+	defer t.p.mu.Unlock()
+	t.tp.Done += n
+}
+
+// Finish removes the task from the heartbeats.
+func (t *Tracker) Finish() {
+	t.p.mu.Lock()
+	defer t.p.mu.Unlock()
+	delete(t.p.tasks, t)
+}
+
+// Heartbeat lists the tasks in progress, ordered by run, step and partition.
+func (p *Progress) Heartbeat() tasks.Heartbeat {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	hb := tasks.Heartbeat{Tasks: make([]tasks.TaskProgress, 0, len(p.tasks))}
+	for t := range p.tasks {
+		hb.Tasks = append(hb.Tasks, t.tp)
+	}
+	sort.Slice(hb.Tasks, func(i, j int) bool {
+		a, b := hb.Tasks[i], hb.Tasks[j]
+		if a.RunID != b.RunID {
+			return a.RunID < b.RunID
+		}
+		if a.Step != b.Step {
+			return a.Step < b.Step
+		}
+		return a.Partition < b.Partition
+	})
+	return hb
+}
+
+// SendHeartbeats sends the worker's progress every interval until ctx is
+// done.
+func (w *Worker) SendHeartbeats(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		hb := w.Progress.Heartbeat()
+		hb.WorkerID = w.ID
+		err := w.Transport.Heartbeat(ctx, hb)
+		if err != nil {
+			w.Log.Warn("heartbeat failed", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
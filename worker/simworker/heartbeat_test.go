@@ -0,0 +1,39 @@
+package simworker
+
+import (
+	"testing"
+
+	"github.com/LeBronQ/tasks"
+)
+
+func TestProgressTracksTasksSeparately(t *testing.T) {
+	p := &Progress{}
+	a := p.Start(&tasks.KDtreeDeliveryPayload{RunID: "run", Step: 1, Partition: 2}, 10)
+	b := p.Start(&tasks.KDtreeDeliveryPayload{RunID: "run", Step: 1, Partition: 1}, 4)
+	a.Add(3)
+	b.Add(4)
+	a.Add(2)
+
+	hb := p.Heartbeat()
+	want := []tasks.TaskProgress{
+		{RunID: "run", Step: 1, Partition: 1, Done: 4, Total: 4},
+		{RunID: "run", Step: 1, Partition: 2, Done: 5, Total: 10},
+	}
+	if len(hb.Tasks) != len(want) {
+		t.Fatalf("%d tasks in the heartbeat, want %d", len(hb.Tasks), len(want))
+	}
+	for i := range want {
+		if hb.Tasks[i] != want[i] {
+			t.Errorf("task %d: %+v, want %+v", i, hb.Tasks[i], want[i])
+		}
+	}
+
+	b.Finish()
+	if hb := p.Heartbeat(); len(hb.Tasks) != 1 || hb.Tasks[0].Partition != 2 {
+		t.Errorf("after finishing partition 1: %+v", hb.Tasks)
+	}
+	a.Finish()
+	if hb := p.Heartbeat(); len(hb.Tasks) != 0 {
+		t.Errorf("idle worker reports %+v", hb.Tasks)
+	}
+}
@@ -0,0 +1,298 @@
+// Package simworker computes the links and neighbor sets of the partitions
+// the controller hands to a worker.
+package simworker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/LeBronQ/Mobility"
+	"github.com/LeBronQ/RadioChannelModel"
+	"github.com/LeBronQ/discovery"
+	"github.com/LeBronQ/kdtree"
+	"github.com/LeBronQ/kdtree/kdrange"
+	"github.com/LeBronQ/kdtree/points"
+	"github.com/LeBronQ/tasks"
+	"github.com/LeBronQ/tasks/metrics"
+	"github.com/LeBronQ/tasks/tracing"
+	"github.com/LeBronQ/tasks/transport"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type Node struct {
+	ID      int64
+	MobNode Mobility.Node
+	WNode   RadioChannelModel.WirelessNode
+	Range   float64
+	Channel ChannelModel
+}
+
+type ChannelModel struct {
+	LargeScaleModel string `json:"largescalemodel"`
+	SmallScaleModel string `json:"smallscalemodel"`
+}
+
+type ChannelReqParams struct {
+	LinkId     int64                          `json:"linkid"`
+	Seed       int64                          `json:"seed"`
+	TxNode     RadioChannelModel.WirelessNode `json:"txnode"`
+	RxNode     RadioChannelModel.WirelessNode `json:"rxnode"`
+	TxPosition RadioChannelModel.Position     `json:"txposition"`
+	RxPosition RadioChannelModel.Position     `json:"rxposition"`
+	Model      ChannelModel                   `json:"model"`
+}
+
+type TreeNodeData struct {
+	ID int64
+}
+
+// NodesFromPayload rebuilds the controller's node set from the delivered
+// descriptors. The result is indexed by node ID.
+func NodesFromPayload(descs []tasks.NodeDescriptor) ([]*Node, error) {
+	arr := make([]*Node, len(descs))
+	for i, d := range descs {
+		if d.ID != int64(i) {
+			return nil, fmt.Errorf("node %d delivered at index %d", d.ID, i)
+		}
+		arr[i] = &Node{
+			ID: d.ID,
+			MobNode: Mobility.Node{
+				ID:    d.ID,
+				Pos:   Mobility.Position(d.Position),
+				V:     Mobility.Speed(d.Velocity),
+				Model: d.MobilityModel,
+			},
+			WNode: RadioChannelModel.WirelessNode{
+				Frequency:  d.Radio.Frequency,
+				BitRate:    d.Radio.BitRate,
+				Modulation: d.Radio.Modulation,
+				BandWidth:  d.Radio.BandWidth,
+				M:          d.Radio.M,
+				PowerInDbm: d.Radio.PowerInDbm,
+			},
+			Range: d.Range,
+			Channel: ChannelModel{
+				LargeScaleModel: d.LargeScaleModel,
+				SmallScaleModel: d.SmallScaleModel,
+			},
+		}
+	}
+	return arr, nil
+}
+
+// LinkID numbers the directed link from tx to rx uniquely within a run of
+// nodeNum nodes.
+func LinkID(tx int64, rx int64, nodeNum int) int64 {
+	return tx*int64(nodeNum) + rx
+}
+
+// Worker computes partitions for the controller. Several workers can run in
+// one process.
+type Worker struct {
+	ID        int
+	Transport transport.Worker
+	// Channel is the pool of channel model service instances.
+	Channel  *discovery.Pool
+	Progress *Progress
+	Log      *slog.Logger
+}
+
+func New(id int, t transport.Worker, channel *discovery.Pool) *Worker {
+	return &Worker{
+		ID:        id,
+		Transport: t,
+		Channel:   channel,
+		Progress:  &Progress{},
+		Log:       slog.Default(),
+	}
+}
+
+// Serve computes the tasks of queue until ctx is done.
+func (w *Worker) Serve(ctx context.Context, queue string, concurrency int) error {
+	return w.Transport.Serve(ctx, queue, concurrency, w.Handle)
+}
+
+// Handle computes one partition task, stores its result and reports it to
+// the controller.
+func (w *Worker) Handle(ctx context.Context, payload *tasks.KDtreeDeliveryPayload) (err error) {
+	ctx, span := tracing.Start(tracing.Extract(ctx, payload.TraceContext), "HandleKDtreeDeliveryTask", trace.WithAttributes(
+		attribute.String("run", payload.RunID),
+		attribute.Int("step", payload.Step),
+		attribute.Int("partition", payload.Partition),
+		attribute.Int("worker", w.ID),
+		attribute.Int("sources", len(payload.Sources)),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	if payload.Version != tasks.PayloadVersion {
+		return fmt.Errorf("unsupported payload version %d, want %d: %w", payload.Version, tasks.PayloadVersion, transport.ErrPermanent)
+	}
+	arr, err := NodesFromPayload(payload.Nodes)
+	if err != nil {
+		return fmt.Errorf("invalid payload: %v: %w", err, transport.ErrPermanent)
+	}
+	for _, src := range payload.Sources {
+		if src < 0 || src >= int64(len(arr)) {
+			return fmt.Errorf("invalid payload: unknown source node %d: %w", src, transport.ErrPermanent)
+		}
+	}
+
+	// A retried or redelivered task only reports the result stored by the
+	// attempt that finished first.
+	stored, err := w.Transport.FetchResult(ctx, payload.RunID, payload.Step, payload.Partition, tasks.SourcesHash(payload.Sources))
+	if err == nil {
+		w.Log.Info("partition was already computed", "run", payload.RunID, "step", payload.Step, "partition", payload.Partition, "by", stored.WorkerID)
+		return w.TaskFinishInform(ctx, payload, stored)
+	}
+	if err != transport.ErrNoResult {
+		return err
+	}
+
+	_, build := tracing.Start(ctx, "kdtree.New", trace.WithAttributes(attribute.Int("nodes", len(arr))))
+	var nodes []kdtree.Point
+	for _, n := range arr {
+		p := points.NewPoint([]float64{n.MobNode.Pos.X, n.MobNode.Pos.Y, n.MobNode.Pos.Z}, TreeNodeData{ID: n.ID})
+		nodes = append(nodes, p)
+	}
+	tree := kdtree.New(nodes)
+	build.End()
+	return w.UpdateNeighborsAndCalculatePLR(ctx, tree, arr, payload)
+}
+
+// QueryBall returns the points of tree within distance r of center. The ball
+// query of kdtree skips the far side of a split whenever the split point
+// itself is out of range, so the points are taken from the enclosing box and
+// filtered by distance instead.
+func QueryBall(tree *kdtree.KDTree, center kdtree.Point, r float64) []kdtree.Point {
+	limits := make([]float64, 0, 2*center.Dimensions())
+	for i := 0; i < center.Dimensions(); i++ {
+		limits = append(limits, center.Dimension(i)-r, center.Dimension(i)+r)
+	}
+	res := []kdtree.Point{}
+	for _, p := range tree.RangeSearch(kdrange.New(limits...)) {
+		if distance(p, center) <= r {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+func distance(a kdtree.Point, b kdtree.Point) float64 {
+	return Mobility.CalculateDistance3D(
+		Mobility.Position{X: a.Dimension(0), Y: a.Dimension(1), Z: a.Dimension(2)},
+		Mobility.Position{X: b.Dimension(0), Y: b.Dimension(1), Z: b.Dimension(2)},
+	)
+}
+
+func (w *Worker) UpdateNeighborsAndCalculatePLR(ctx context.Context, tree *kdtree.KDTree, NodeArr []*Node, payload *tasks.KDtreeDeliveryPayload) error {
+	seed, step := payload.Seed, payload.Step
+	start := time.Now()
+	cnt := 0
+	groups := [][]LinkRequest{}
+	neighbors := []tasks.NeighborSet{}
+	for _, src := range payload.Sources {
+		cnt++
+		node := NodeArr[src]
+		distance := node.Range
+		center := points.NewPoint([]float64{node.MobNode.Pos.X, node.MobNode.Pos.Y, node.MobNode.Pos.Z}, TreeNodeData{ID: node.ID})
+		_, query := tracing.Start(ctx, "QueryBallPoint", trace.WithAttributes(attribute.Int64("node", node.ID)))
+		res := QueryBall(tree, center, distance)
+		query.SetAttributes(attribute.Int("neighbors", len(res)-1))
+		query.End()
+		group := []LinkRequest{}
+		set := tasks.NeighborSet{ID: node.ID, Neighbors: []int64{}}
+		for _, neigh := range res {
+			neigh_ID := neigh.GetData().(TreeNodeData).ID
+			if node.ID == neigh_ID {
+				continue
+			} else {
+				neigh_node := NodeArr[neigh_ID]
+				link_id := LinkID(node.ID, neigh_ID, len(NodeArr))
+				set.Neighbors = append(set.Neighbors, neigh_ID)
+				group = append(group, LinkRequest{
+					TxID: node.ID,
+					RxID: neigh_ID,
+					Params: ChannelReqParams{
+						LinkId:     link_id,
+						Seed:       tasks.DeriveSeed(seed, int64(step), link_id),
+						TxNode:     node.WNode,
+						RxNode:     neigh_node.WNode,
+						TxPosition: RadioChannelModel.Position(node.MobNode.Pos),
+						RxPosition: RadioChannelModel.Position(neigh_node.MobNode.Pos),
+						Model:      node.Channel,
+					},
+				})
+			}
+		}
+		sort.Slice(set.Neighbors, func(a, b int) bool { return set.Neighbors[a] < set.Neighbors[b] })
+		metrics.Neighbors.Observe(float64(len(set.Neighbors)))
+		neighbors = append(neighbors, set)
+		groups = append(groups, group)
+	}
+	queryTime := metrics.ObservePhase(metrics.PhaseNeighborQuery, start)
+	total := 0
+	for _, g := range groups {
+		total += len(g)
+	}
+	tracker := w.Progress.Start(payload, total)
+	defer tracker.Finish()
+	start = time.Now()
+	links, calls, err := w.CalculateLinks(ctx, tracker, groups, step)
+	channelTime := metrics.ObservePhase(metrics.PhaseChannel, start)
+	if err != nil {
+		w.TaskFailInform(ctx, payload, calls)
+		return fmt.Errorf("step %d partition %d: %v", step, payload.Partition, err)
+	}
+	w.Log.Info("partition computed", "run", payload.RunID, "step", step, "partition", payload.Partition, "sources", cnt, "links", len(links))
+	result, err := w.Transport.StoreResult(ctx, payload.RunID, tasks.PartitionResult{
+		Step:          payload.Step,
+		Partition:     payload.Partition,
+		SourcesHash:   tasks.SourcesHash(payload.Sources),
+		WorkerID:      w.ID,
+		Links:         links,
+		Neighbors:     neighbors,
+		NeighborQuery: queryTime,
+		Channel:       channelTime,
+		ChannelCalls:  calls,
+	})
+	if err != nil {
+		return err
+	}
+	return w.TaskFinishInform(ctx, payload, result)
+}
+
+// TaskFinishInform reports a stored partition result to the controller. The
+// controller counts a partition once no matter how often it is reported.
+func (w *Worker) TaskFinishInform(ctx context.Context, payload *tasks.KDtreeDeliveryPayload, result tasks.PartitionResult) error {
+	return w.Transport.Notify(ctx, tasks.TaskNotification{
+		RunID:       payload.RunID,
+		Step:        payload.Step,
+		Partition:   payload.Partition,
+		SourcesHash: result.SourcesHash,
+		WorkerID:    result.WorkerID,
+		SourceCount: len(payload.Sources),
+		LinkCount:   len(result.Links),
+	})
+}
+
+// TaskFailInform reports the channel requests of a failed task so the
+// controller counts them even though the partition has no result.
+func (w *Worker) TaskFailInform(ctx context.Context, payload *tasks.KDtreeDeliveryPayload, calls tasks.ServiceCalls) {
+	err := w.Transport.Notify(ctx, tasks.TaskNotification{
+		RunID:        payload.RunID,
+		Step:         payload.Step,
+		Partition:    payload.Partition,
+		SourcesHash:  tasks.SourcesHash(payload.Sources),
+		WorkerID:     w.ID,
+		SourceCount:  len(payload.Sources),
+		Failed:       true,
+		ChannelCalls: calls,
+	})
+	if err != nil {
+		w.Log.Warn("failure notification not sent", "run", payload.RunID, "step", payload.Step, "partition", payload.Partition, "err", err)
+	}
+}